@@ -15,12 +15,7 @@
 package formatter
 
 import (
-	"fmt"
-	"os"
 	"strconv"
-	"strings"
-
-	"github.com/mattn/go-isatty"
 )
 
 const (
@@ -28,313 +23,119 @@ const (
 	greenOffset = 8
 )
 
-var gBrightMap = map[string]string{ // nolint: gochecknoglobals
-	"\033[30m":  "\033[90m",
-	"\033[31m":  "\033[91m",
-	"\033[32m":  "\033[92m",
-	"\033[33m":  "\033[93m",
-	"\033[34m":  "\033[94m",
-	"\033[35m":  "\033[95m",
-	"\033[36m":  "\033[96m",
-	"\033[37m":  "\033[97m",
-	"\033[40m":  "\033[100m",
-	"\033[41m":  "\033[101m",
-	"\033[42m":  "\033[102m",
-	"\033[43m":  "\033[103m",
-	"\033[44m":  "\033[104m",
-	"\033[45m":  "\033[105m",
-	"\033[46m":  "\033[106m",
-	"\033[47m":  "\033[107m",
-	"\033[90m":  "\033[90m",
-	"\033[91m":  "\033[91m",
-	"\033[92m":  "\033[92m",
-	"\033[93m":  "\033[93m",
-	"\033[94m":  "\033[94m",
-	"\033[95m":  "\033[95m",
-	"\033[96m":  "\033[96m",
-	"\033[97m":  "\033[97m",
-	"\033[100m": "\033[100m",
-	"\033[101m": "\033[101m",
-	"\033[102m": "\033[102m",
-	"\033[103m": "\033[103m",
-	"\033[104m": "\033[104m",
-	"\033[105m": "\033[105m",
-	"\033[106m": "\033[106m",
-	"\033[107m": "\033[107m",
-}
-
-var gOffMap = map[string]string{ // nolint: gochecknoglobals
-	"\033[1m":  "\033[21m",
-	"\033[2m":  "\033[22m",
-	"\033[3m":  "\033[23m",
-	"\033[4m":  "\033[24m",
-	"\033[5m":  "\033[25m",
-	"\033[7m":  "\033[27m",
-	"\033[8m":  "\033[28m",
-	"\033[9m":  "\033[29m",
-	"\033[21m": "\033[21m",
-	"\033[22m": "\033[22m",
-	"\033[23m": "\033[23m",
-	"\033[24m": "\033[24m",
-	"\033[25m": "\033[25m",
-	"\033[27m": "\033[27m",
-	"\033[28m": "\033[28m",
-	"\033[29m": "\033[29m",
-	"\033[53m": "\033[55m",
-	"\033[55m": "\033[55m",
-}
-
-var gBackgroundMap = map[string]string{ // nolint: gochecknoglobals,dupl
-	"\033[0m":   "\033[49m",
-	"\033[30m":  "\033[40m",
-	"\033[31m":  "\033[41m",
-	"\033[32m":  "\033[42m",
-	"\033[33m":  "\033[43m",
-	"\033[34m":  "\033[44m",
-	"\033[35m":  "\033[45m",
-	"\033[36m":  "\033[46m",
-	"\033[37m":  "\033[47m",
-	"\033[40m":  "\033[40m",
-	"\033[41m":  "\033[41m",
-	"\033[42m":  "\033[42m",
-	"\033[43m":  "\033[43m",
-	"\033[44m":  "\033[44m",
-	"\033[45m":  "\033[45m",
-	"\033[46m":  "\033[46m",
-	"\033[47m":  "\033[47m",
-	"\033[90m":  "\033[100m",
-	"\033[91m":  "\033[101m",
-	"\033[92m":  "\033[102m",
-	"\033[93m":  "\033[103m",
-	"\033[94m":  "\033[104m",
-	"\033[95m":  "\033[105m",
-	"\033[96m":  "\033[106m",
-	"\033[97m":  "\033[107m",
-	"\033[100m": "\033[100m",
-	"\033[101m": "\033[101m",
-	"\033[102m": "\033[102m",
-	"\033[103m": "\033[103m",
-	"\033[104m": "\033[104m",
-	"\033[105m": "\033[105m",
-	"\033[106m": "\033[106m",
-	"\033[107m": "\033[107m",
-}
-
-var gForegroundMap = map[string]string{ // nolint: gochecknoglobals,dupl
-	"\033[0m":   "\033[39m",
-	"\033[30m":  "\033[30m",
-	"\033[31m":  "\033[31m",
-	"\033[32m":  "\033[32m",
-	"\033[33m":  "\033[33m",
-	"\033[34m":  "\033[34m",
-	"\033[35m":  "\033[35m",
-	"\033[36m":  "\033[36m",
-	"\033[37m":  "\033[37m",
-	"\033[40m":  "\033[30m",
-	"\033[41m":  "\033[31m",
-	"\033[42m":  "\033[32m",
-	"\033[43m":  "\033[33m",
-	"\033[44m":  "\033[34m",
-	"\033[45m":  "\033[35m",
-	"\033[46m":  "\033[36m",
-	"\033[47m":  "\033[37m",
-	"\033[90m":  "\033[90m",
-	"\033[91m":  "\033[91m",
-	"\033[92m":  "\033[92m",
-	"\033[93m":  "\033[93m",
-	"\033[94m":  "\033[94m",
-	"\033[95m":  "\033[95m",
-	"\033[96m":  "\033[96m",
-	"\033[97m":  "\033[97m",
-	"\033[100m": "\033[90m",
-	"\033[101m": "\033[91m",
-	"\033[102m": "\033[92m",
-	"\033[103m": "\033[93m",
-	"\033[104m": "\033[94m",
-	"\033[105m": "\033[95m",
-	"\033[106m": "\033[96m",
-	"\033[107m": "\033[97m",
-}
-
-var gColorMap = map[string]string{ // nolint: gochecknoglobals
-	"default": "\033[0m",
-	"normal":  "\033[0m",
-	"reset":   "\033[0m",
-	"black":   "\033[30m",
-	"red":     "\033[31m",
-	"green":   "\033[32m",
-	"yellow":  "\033[33m",
-	"blue":    "\033[34m",
-	"magenta": "\033[35m",
-	"cyan":    "\033[36m",
-	"white":   "\033[37m",
-	"gray":    "\033[90m",
-}
-
-func isTerminal() bool {
-	return isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd())
-}
-
-func setDummy() string {
-	return ""
-}
+const (
+	ansiForeground = 30
+	ansiBackground = 40
+	ansiBright     = 60
+	ansiExtended   = 8
+	ansiDefault    = 9
+)
 
-func setDummyTransform(string) (string, error) {
-	return "", nil
+var gANSIAttributes = map[Attribute][2]int{ // nolint: gochecknoglobals
+	AttributeBold:      {1, 21},
+	AttributeFaint:     {2, 22},
+	AttributeItalic:    {3, 23},
+	AttributeUnderline: {4, 24},
+	AttributeOverline:  {53, 55},
+	AttributeBlink:     {5, 25},
+	AttributeInvert:    {7, 27},
+	AttributeHide:      {8, 28},
+	AttributeStrike:    {9, 29},
 }
 
-func setDummyRGB(int, int, int) string {
-	return ""
+// ANSIStyleRenderer renders styles using ANSI escape sequences. Colors are
+// mapped to the nearest color supported by color profile. ColorProfileAuto
+// uses color profile detected by DetectColorProfile. Hyperlinks are rendered
+// using OSC 8 escape sequences.
+type ANSIStyleRenderer struct {
+	Profile ColorProfile
 }
 
-func setNormal() string {
+// Reset returns escape sequence that ends all text attributes and colors.
+func (ANSIStyleRenderer) Reset() string {
 	return "\033[0m"
 }
 
-func setBold() string {
-	return "\033[1m"
-}
-
-func setFaint() string {
-	return "\033[2m"
-}
-
-func setItalic() string {
-	return "\033[3m"
-}
-
-func setUnderline() string {
-	return "\033[4m"
-}
-
-func setOverline() string {
-	return "\033[53m"
-}
-
-func setBlink() string {
-	return "\033[5m"
-}
-
-func setInvert() string {
-	return "\033[7m"
-}
-
-func setHide() string {
-	return "\033[8m"
-}
-
-func setStrike() string {
-	return "\033[9m"
-}
-
-func setBlack() string {
-	return "\033[30m"
-}
-
-func setRed() string {
-	return "\033[31m"
-}
-
-func setGreen() string {
-	return "\033[32m"
-}
-
-func setYellow() string {
-	return "\033[33m"
-}
-
-func setBlue() string {
-	return "\033[34m"
+// Attribute returns escape sequence that enables text attribute.
+func (ANSIStyleRenderer) Attribute(attribute Attribute) string {
+	return setSGR(gANSIAttributes[attribute][0])
 }
 
-func setMagenta() string {
-	return "\033[35m"
+// AttributeOff returns escape sequence that disables text attribute.
+func (ANSIStyleRenderer) AttributeOff(attribute Attribute) string {
+	return setSGR(gANSIAttributes[attribute][1])
 }
 
-func setCyan() string {
-	return "\033[36m"
+// Foreground returns escape sequence that sets foreground color.
+func (r ANSIStyleRenderer) Foreground(color Color) string {
+	return r.setColor(color, ansiForeground)
 }
 
-func setWhite() string {
-	return "\033[37m"
+// Background returns escape sequence that sets background color.
+func (r ANSIStyleRenderer) Background(color Color) string {
+	return r.setColor(color, ansiBackground)
 }
 
-func setGray() string {
-	return "\033[90m"
+// Link returns OSC 8 hyperlink to URL with text.
+func (ANSIStyleRenderer) Link(url, text string) string {
+	return "\033]8;;" + url + "\033\\" + text + "\033]8;;\033\\"
 }
 
-func setBell() string {
+// Bell returns bell character.
+func (ANSIStyleRenderer) Bell() string {
 	return "\a"
 }
 
-func setColor(in string) (out string, err error) {
-	var ok bool
-
-	in = strings.TrimSpace(strings.ToLower(in))
+func (r ANSIStyleRenderer) setColor(color Color, base int) string {
+	profile := r.Profile
 
-	if out, ok = gColorMap[in]; ok {
-		return out, nil
+	if profile == ColorProfileAuto {
+		profile = gColorProfile
 	}
 
-	if strings.HasPrefix(in, "0x") {
-		var value uint64
-
-		if value, err = strconv.ParseUint(strings.TrimPrefix(in, "0x"), 16, 24); err != nil {
-			return "", err
-		}
-
-		return setRGB(uint8(value>>redOffset), uint8(value>>greenOffset), uint8(value)), nil
+	if profile == ColorProfileNone {
+		return ""
 	}
 
-	return "", fError("color is not supported")
-}
+	switch color.Type {
+	case ColorANSI:
+		return setANSI(color.Index, base)
+	case ColorANSI256:
+		if profile == ColorProfileANSI {
+			if color.Index < ansi256Standard {
+				return setANSI(color.Index, base)
+			}
 
-func setOff(in string) (string, error) {
-	if out, ok := gOffMap[in]; ok {
-		return out, nil
-	}
-
-	return "", fError("off can be used with that function")
-}
-
-func setRGB(red, green, blue uint8) string {
-	return fmt.Sprintf("\033[38;2;%d;%d;%dm", red, green, blue)
-}
+			return setANSI(toANSI(fromANSI256(color.Index)), base)
+		}
 
-func setBright(in string) (string, error) {
-	if out, ok := gBrightMap[in]; ok {
-		return out, nil
+		return "\033[" + strconv.Itoa(base+ansiExtended) + ";5;" + strconv.Itoa(color.Index) + "m"
+	case ColorRGB:
+		red, green, blue := int(color.Red), int(color.Green), int(color.Blue)
+
+		switch profile {
+		case ColorProfileANSI256:
+			return "\033[" + strconv.Itoa(base+ansiExtended) + ";5;" + strconv.Itoa(toANSI256(red, green, blue)) + "m"
+		case ColorProfileANSI:
+			return setANSI(toANSI(red, green, blue), base)
+		default:
+			return "\033[" + strconv.Itoa(base+ansiExtended) + ";2;" + strconv.Itoa(red) + ";" +
+				strconv.Itoa(green) + ";" + strconv.Itoa(blue) + "m"
+		}
+	default:
+		return setSGR(base + ansiDefault)
 	}
-
-	return "", fError("bright can be used only with colors")
 }
 
-func setBackground(in string) (string, error) {
-	if out, ok := gBackgroundMap[in]; ok {
-		return out, nil
+// setANSI returns escape sequence for one of 16 standard and bright colors.
+func setANSI(index, base int) string {
+	if index < 8 {
+		return setSGR(base + index)
 	}
 
-	switch {
-	case strings.HasPrefix(in, "\033[38"):
-		return "\033[48" + strings.TrimPrefix(in, "\033[38"), nil
-	case strings.HasPrefix(in, "\033[48"):
-		return in, nil
-	default:
-		return "", fError("background can be used only with colors")
-	}
+	return setSGR(base + ansiBright + index - 8)
 }
 
-func setForeground(in string) (out string, err error) {
-	if out, ok := gForegroundMap[in]; ok {
-		return out, nil
-	}
-
-	switch {
-	case strings.HasPrefix(in, "\033[48"):
-		return "\033[38" + strings.TrimPrefix(in, "\033[48"), nil
-	case strings.HasPrefix(in, "\033[38"):
-		return in, nil
-	default:
-		return "", fError("foreground can be used only with colors")
-	}
+func setSGR(code int) string {
+	return "\033[" + strconv.Itoa(code) + "m"
 }
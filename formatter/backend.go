@@ -0,0 +1,484 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	sgrPrefix        = "\033["
+	sgrSuffix        = "m"
+	linkPrefix       = "\033]8;"
+	escapeMarkerSize = 8
+)
+
+// gEscapeMarker follows escape characters rendered by backendRenderer.
+// Other escape characters come from formatted values and they are removed
+// before formatted message is passed to backend. Values cannot guess it.
+var gEscapeMarker = newEscapeMarker() // nolint: gochecknoglobals
+
+// gBackendRenderer renders escape sequences parsed by backends.
+var gBackendRenderer = ANSIStyleRenderer{Profile: ColorProfileTrueColor} // nolint: gochecknoglobals
+
+var gSafeSchemes = map[string]bool{ // nolint: gochecknoglobals
+	"":       true,
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+	"ftp":    true,
+	"file":   true,
+}
+
+var gMarkdownEscaper = strings.NewReplacer( // nolint: gochecknoglobals
+	"\\", "\\\\",
+	"*", "\\*",
+	"_", "\\_",
+	"~", "\\~",
+	"`", "\\`",
+	"[", "\\[",
+	"]", "\\]",
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+)
+
+var gMarkdownLinkEscaper = strings.NewReplacer( // nolint: gochecknoglobals
+	"(", "%28",
+	")", "%29",
+	" ", "%20",
+	"<", "%3C",
+	">", "%3E",
+	"\t", "%09",
+	"\n", "%0A",
+	"\r", "%0D",
+)
+
+// Backend renders formatted message with ANSI escape sequences to other
+// markup. Formatter with backend always formats message with ANSI escape
+// sequences and passes it to backend before writing it to writer. Error
+// returned by backend is returned as ErrWriter error.
+type Backend func(text string) (string, error)
+
+// Span defines part of formatted message with the same style.
+type Span struct {
+	Text  string    `json:"text"`
+	Style SpanStyle `json:"style"`
+}
+
+// SpanStyle defines style of span. Colors are in the #RRGGBB format. Empty
+// color is the default color.
+type SpanStyle struct {
+	Bold       bool   `json:"bold,omitempty"`
+	Faint      bool   `json:"faint,omitempty"`
+	Italic     bool   `json:"italic,omitempty"`
+	Underline  bool   `json:"underline,omitempty"`
+	Overline   bool   `json:"overline,omitempty"`
+	Blink      bool   `json:"blink,omitempty"`
+	Invert     bool   `json:"invert,omitempty"`
+	Hide       bool   `json:"hide,omitempty"`
+	Strike     bool   `json:"strike,omitempty"`
+	Foreground string `json:"foreground,omitempty"`
+	Background string `json:"background,omitempty"`
+	Link       string `json:"link,omitempty"`
+}
+
+// ParseSpans splits text with ANSI escape sequences to spans with the same
+// style. It understands SGR colors and text attributes and OSC 8 hyperlinks.
+// Other escape sequences are removed. Spans with empty text are skipped.
+func ParseSpans(text string) []Span {
+	var spans []Span
+
+	var style SpanStyle
+
+	for text != "" {
+		start, end := findEscapeSequence(text)
+
+		if start < 0 {
+			start, end = len(text), len(text)
+		}
+
+		if start > 0 {
+			if last := len(spans) - 1; (last >= 0) && (spans[last].Style == style) {
+				spans[last].Text += text[:start]
+			} else {
+				spans = append(spans, Span{Text: text[:start], Style: style})
+			}
+		}
+
+		style.apply(text[start:end])
+		text = text[end:]
+	}
+
+	return spans
+}
+
+// HTMLBackend renders formatted message to HTML. Styled spans are rendered
+// as <span> elements with inline CSS style and hyperlinks as <a> elements.
+// Hyperlinks with schemes other than http, https, mailto, ftp and file are
+// rendered as text.
+func HTMLBackend(text string) (string, error) {
+	var builder strings.Builder
+
+	for _, s := range ParseSpans(text) {
+		content := html.EscapeString(s.Text)
+
+		if css := s.Style.css(); css != "" {
+			content = `<span style="` + css + `">` + content + "</span>"
+		}
+
+		if isSafeLink(s.Style.Link) {
+			content = `<a href="` + html.EscapeString(s.Style.Link) + `">` + content + "</a>"
+		}
+
+		builder.WriteString(content)
+	}
+
+	return builder.String(), nil
+}
+
+// MarkdownBackend renders formatted message to Markdown. Bold, italic and
+// strike text attributes and hyperlinks are rendered using Markdown
+// emphasis and links. Colors and other text attributes are dropped. Text is
+// escaped, including HTML special characters like < and &. Links
+// with unsafe schemes like javascript are dropped, parentheses and spaces
+// in URLs are percent-encoded.
+func MarkdownBackend(text string) (string, error) {
+	var builder strings.Builder
+
+	for _, s := range ParseSpans(text) {
+		content := strings.TrimRightFunc(s.Text, unicode.IsSpace)
+		trailing := s.Text[len(content):]
+		trimmed := strings.TrimLeftFunc(content, unicode.IsSpace)
+		leading := content[:len(content)-len(trimmed)]
+
+		if trimmed == "" {
+			builder.WriteString(s.Text)
+			continue
+		}
+
+		content = gMarkdownEscaper.Replace(trimmed)
+
+		for _, e := range []struct {
+			enabled bool
+			marker  string
+		}{
+			{s.Style.Strike, "~~"},
+			{s.Style.Italic, "_"},
+			{s.Style.Bold, "**"},
+		} {
+			if e.enabled {
+				content = e.marker + content + e.marker
+			}
+		}
+
+		if isSafeLink(s.Style.Link) {
+			content = "[" + content + "](" + gMarkdownLinkEscaper.Replace(s.Style.Link) + ")"
+		}
+
+		builder.WriteString(leading + content + trailing)
+	}
+
+	return builder.String(), nil
+}
+
+// SpansBackend renders formatted message to JSON array of spans.
+// See ParseSpans for details.
+func SpansBackend(text string) (string, error) {
+	spans := ParseSpans(text)
+
+	if spans == nil {
+		spans = []Span{}
+	}
+
+	data, err := json.Marshal(spans)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// backendRenderer renders true color ANSI escape sequences with escape
+// characters marked by gEscapeMarker.
+type backendRenderer struct{}
+
+// escapeWriter writes text with escape characters rendered by
+// backendRenderer and removes other escape characters.
+type escapeWriter struct {
+	writer io.Writer
+}
+
+// Reset returns marked escape sequence that ends all text attributes and colors.
+func (backendRenderer) Reset() string {
+	return markEscapes(gBackendRenderer.Reset())
+}
+
+// Attribute returns marked escape sequence that enables text attribute.
+func (backendRenderer) Attribute(attribute Attribute) string {
+	return markEscapes(gBackendRenderer.Attribute(attribute))
+}
+
+// AttributeOff returns marked escape sequence that disables text attribute.
+func (backendRenderer) AttributeOff(attribute Attribute) string {
+	return markEscapes(gBackendRenderer.AttributeOff(attribute))
+}
+
+// Foreground returns marked escape sequence that sets foreground color.
+func (backendRenderer) Foreground(color Color) string {
+	return markEscapes(gBackendRenderer.Foreground(color))
+}
+
+// Background returns marked escape sequence that sets background color.
+func (backendRenderer) Background(color Color) string {
+	return markEscapes(gBackendRenderer.Background(color))
+}
+
+// Link returns marked OSC 8 hyperlink to URL with text. Escape characters
+// and bells in URL and not marked escape characters in text are removed.
+func (backendRenderer) Link(url, text string) string {
+	url = strings.ReplaceAll(unmarkEscapes(url), string(bell), "")
+
+	return markEscapes(gBackendRenderer.Link(url, unmarkEscapes(text)))
+}
+
+// Bell returns bell character.
+func (backendRenderer) Bell() string {
+	return gBackendRenderer.Bell()
+}
+
+// Write writes data with marked escape characters and without other escape
+// characters.
+func (w escapeWriter) Write(data []byte) (int, error) {
+	if _, err := io.WriteString(w.writer, unmarkEscapes(string(data))); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// apply changes style using SGR or OSC 8 hyperlink escape sequence.
+func (s *SpanStyle) apply(sequence string) {
+	switch {
+	case strings.HasPrefix(sequence, sgrPrefix) && strings.HasSuffix(sequence, sgrSuffix):
+		s.applySGR(strings.Split(sequence[len(sgrPrefix):len(sequence)-len(sgrSuffix)], ";"))
+	case strings.HasPrefix(sequence, linkPrefix):
+		link := strings.TrimSuffix(strings.TrimSuffix(sequence[len(linkPrefix):], "\033\\"), "\a")
+
+		if separator := strings.IndexByte(link, ';'); separator >= 0 {
+			s.Link = link[separator+1:]
+		}
+	}
+}
+
+// applySGR changes style using parameters of SGR escape sequence.
+func (s *SpanStyle) applySGR(parameters []string) { // nolint: gocyclo
+	for index := 0; index < len(parameters); index++ {
+		code, err := strconv.Atoi(parameters[index])
+
+		if err != nil {
+			code = 0
+		}
+
+		switch {
+		case code == 0:
+			*s = SpanStyle{Link: s.Link}
+		case code == 1:
+			s.Bold = true
+		case code == 2:
+			s.Faint = true
+		case code == 3:
+			s.Italic = true
+		case code == 4:
+			s.Underline = true
+		case code == 5:
+			s.Blink = true
+		case code == 7:
+			s.Invert = true
+		case code == 8:
+			s.Hide = true
+		case code == 9:
+			s.Strike = true
+		case (code == 21) || (code == 22):
+			s.Bold, s.Faint = false, false
+		case code == 23:
+			s.Italic = false
+		case code == 24:
+			s.Underline = false
+		case code == 25:
+			s.Blink = false
+		case code == 27:
+			s.Invert = false
+		case code == 28:
+			s.Hide = false
+		case code == 29:
+			s.Strike = false
+		case code == 53:
+			s.Overline = true
+		case code == 55:
+			s.Overline = false
+		case (code >= 30) && (code <= 37):
+			s.Foreground = getHexColor(fromANSI256(code - 30))
+		case (code >= 90) && (code <= 97):
+			s.Foreground = getHexColor(fromANSI256(code - 90 + 8))
+		case (code >= 40) && (code <= 47):
+			s.Background = getHexColor(fromANSI256(code - 40))
+		case (code >= 100) && (code <= 107):
+			s.Background = getHexColor(fromANSI256(code - 100 + 8))
+		case code == 39:
+			s.Foreground = ""
+		case code == 49:
+			s.Background = ""
+		case code == 38:
+			s.Foreground, index = getExtendedColor(parameters, index)
+		case code == 48:
+			s.Background, index = getExtendedColor(parameters, index)
+		}
+	}
+}
+
+// css returns inline CSS style for span style.
+func (s *SpanStyle) css() string {
+	var properties, decorations []string
+
+	foreground, background := s.Foreground, s.Background
+
+	if s.Invert {
+		foreground, background = background, foreground
+	}
+
+	for _, p := range []struct {
+		enabled  bool
+		property string
+	}{
+		{foreground != "", "color:" + foreground},
+		{background != "", "background-color:" + background},
+		{s.Bold, "font-weight:bold"},
+		{s.Faint, "opacity:0.5"},
+		{s.Italic, "font-style:italic"},
+		{s.Hide, "visibility:hidden"},
+	} {
+		if p.enabled {
+			properties = append(properties, p.property)
+		}
+	}
+
+	for _, d := range []struct {
+		enabled    bool
+		decoration string
+	}{
+		{s.Underline, "underline"},
+		{s.Overline, "overline"},
+		{s.Strike, "line-through"},
+		{s.Blink, "blink"},
+	} {
+		if d.enabled {
+			decorations = append(decorations, d.decoration)
+		}
+	}
+
+	if len(decorations) > 0 {
+		properties = append(properties, "text-decoration:"+strings.Join(decorations, " "))
+	}
+
+	return strings.Join(properties, ";")
+}
+
+// getExtendedColor returns color from 38 or 48 SGR parameter at provided
+// index followed by 5;N or 2;R;G;B parameters. It returns index of the last
+// used parameter.
+func getExtendedColor(parameters []string, index int) (string, int) {
+	values := make([]int, 0, 4)
+
+	for _, parameter := range parameters[index+1:] {
+		value, err := strconv.Atoi(parameter)
+
+		if err != nil {
+			break
+		}
+
+		values = append(values, value)
+
+		if ((values[0] == 5) && (len(values) == 2)) || (len(values) == 4) {
+			break
+		}
+	}
+
+	switch {
+	case (len(values) == 2) && (values[0] == 5) && (values[1] >= 0) && (values[1] <= ansi256GrayLast):
+		return getHexColor(fromANSI256(values[1])), index + 2
+	case (len(values) == 4) && (values[0] == 2):
+		return getHexColor(values[1]&0xFF, values[2]&0xFF, values[3]&0xFF), index + 4
+	default:
+		return "", len(parameters)
+	}
+}
+
+func isSafeLink(link string) bool {
+	if link == "" {
+		return false
+	}
+
+	u, err := url.Parse(link)
+
+	if err != nil {
+		return false
+	}
+
+	return gSafeSchemes[strings.ToLower(u.Scheme)]
+}
+
+// newEscapeMarker returns random marker of escape characters.
+func newEscapeMarker() string {
+	data := make([]byte, escapeMarkerSize)
+
+	if _, err := rand.Read(data); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return hex.EncodeToString(data)
+}
+
+// markEscapes returns text with all escape characters marked.
+func markEscapes(text string) string {
+	return strings.ReplaceAll(text, string(escape), string(escape)+gEscapeMarker)
+}
+
+// unmarkEscapes returns text with marked escape characters and without
+// other escape characters.
+func unmarkEscapes(text string) string {
+	parts := strings.Split(text, string(escape)+gEscapeMarker)
+
+	for index := range parts {
+		parts[index] = strings.ReplaceAll(parts[index], string(escape), "")
+	}
+
+	return strings.Join(parts, string(escape))
+}
+
+func getHexColor(red, green, blue int) string {
+	return fmt.Sprintf("#%02x%02x%02x", red, green, blue)
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultCacheSize defines default maximum number of parsed messages kept in cache.
+const DefaultCacheSize = 256
+
+var gCache = newCache(DefaultCacheSize) // nolint: gochecknoglobals
+
+var gVersion uint64 // nolint: gochecknoglobals
+
+// CacheStats defines statistics of parsed messages cache.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Length int
+	Size   int
+}
+
+type cacheKey struct {
+	message         string
+	leftDelimiter   string
+	rightDelimiter  string
+	placeholder     string
+	escapeSequences bool
+	target          renderTarget
+	colorProfile    ColorProfile
+	version         uint64
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	compiled *compiled
+}
+
+type cache struct {
+	mutex   sync.Mutex
+	size    int
+	hits    uint64
+	misses  uint64
+	order   *list.List
+	entries map[cacheKey]*list.Element
+}
+
+// SetCacheSize sets maximum number of parsed messages kept in cache.
+// Zero or negative value disables cache. Default is DefaultCacheSize.
+func SetCacheSize(size int) {
+	gCache.resize(size)
+}
+
+// GetCacheSize returns maximum number of parsed messages kept in cache.
+func GetCacheSize() int {
+	gCache.mutex.Lock()
+	defer gCache.mutex.Unlock()
+
+	return gCache.size
+}
+
+// GetCacheStats returns statistics of parsed messages cache.
+func GetCacheStats() CacheStats {
+	gCache.mutex.Lock()
+	defer gCache.mutex.Unlock()
+
+	return CacheStats{
+		Hits:   gCache.hits,
+		Misses: gCache.misses,
+		Length: gCache.order.Len(),
+		Size:   gCache.size,
+	}
+}
+
+// ResetCache removes all parsed messages from cache and clears statistics.
+func ResetCache() {
+	gCache.mutex.Lock()
+	defer gCache.mutex.Unlock()
+
+	gCache.hits = 0
+	gCache.misses = 0
+	gCache.order.Init()
+	gCache.entries = make(map[cacheKey]*list.Element)
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+func nextVersion() uint64 {
+	return atomic.AddUint64(&gVersion, 1)
+}
+
+func (c *cache) get(key cacheKey) *compiled {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.size <= 0 {
+		return nil
+	}
+
+	element, ok := c.entries[key]
+
+	if !ok {
+		c.misses++
+		return nil
+	}
+
+	c.hits++
+	c.order.MoveToFront(element)
+
+	return element.Value.(*cacheEntry).compiled
+}
+
+func (c *cache) add(key cacheKey, value *compiled) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.size <= 0 {
+		return
+	}
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cacheEntry).compiled = value
+		c.order.MoveToFront(element)
+
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{
+		key:      key,
+		compiled: value,
+	})
+
+	c.evict()
+}
+
+func (c *cache) resize(size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.size = size
+	c.evict()
+}
+
+func (c *cache) evict() {
+	for (c.order.Len() > 0) && (c.order.Len() > c.size) {
+		element := c.order.Back()
+		c.order.Remove(element)
+		delete(c.entries, element.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+// These constants define capabilities of built-in functions. They can be
+// combined using the | operator.
+const (
+	// CapabilityOS allows functions that read information about operating
+	// system and process like user, hostname, cwd, executable, pid or absolute.
+	CapabilityOS Capability = 1 << iota
+
+	// CapabilityEnv allows functions that read environment variables like
+	// env and expand.
+	CapabilityEnv
+
+	// CapabilityNetwork allows functions that read network configuration
+	// like ip, ips or mac.
+	CapabilityNetwork
+
+	// CapabilityNone allows only functions without side effects like upper,
+	// json or style functions.
+	CapabilityNone Capability = 0
+
+	// CapabilityAll allows all built-in functions. It is the default.
+	CapabilityAll = CapabilityOS | CapabilityEnv | CapabilityNetwork
+)
+
+// gCapabilities defines capabilities required by built-in functions.
+// Functions not listed here are always allowed.
+var gCapabilities = map[string]Capability{ // nolint: gochecknoglobals
+	"ip":         CapabilityNetwork,
+	"ips":        CapabilityNetwork,
+	"mac":        CapabilityNetwork,
+	"user":       CapabilityOS,
+	"executable": CapabilityOS,
+	"cwd":        CapabilityOS,
+	"hostname":   CapabilityOS,
+	"uid":        CapabilityOS,
+	"gid":        CapabilityOS,
+	"euid":       CapabilityOS,
+	"egid":       CapabilityOS,
+	"pid":        CapabilityOS,
+	"ppid":       CapabilityOS,
+	"absolute":   CapabilityOS,
+	"env":        CapabilityEnv,
+	"expand":     CapabilityEnv,
+}
+
+// Capability defines set of built-in functions allowed by formatter.
+type Capability uint
+
+// NewSandboxed creates a new formatter object for untrusted messages.
+// It allows only built-in functions without access to operating system,
+// environment variables and network. See CapabilityNone.
+func NewSandboxed() *Formatter {
+	return New().SetCapabilities(CapabilityNone)
+}
+
+// Has returns true if all provided capabilities are allowed.
+func (c Capability) Has(capabilities Capability) bool {
+	return c&capabilities == capabilities
+}
+
+// isAllowed returns true if built-in function is allowed by capabilities.
+func isAllowed(name string, capabilities Capability) bool {
+	required, ok := gCapabilities[name]
+
+	return !ok || capabilities.Has(required)
+}
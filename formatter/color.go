@@ -0,0 +1,194 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"os"
+	"strings"
+)
+
+// These constants define terminal color profiles. Colors are automatically
+// mapped to the nearest color supported by color profile.
+const (
+	// ColorProfileAuto detects color profile using DetectColorProfile.
+	ColorProfileAuto ColorProfile = iota
+
+	// ColorProfileNone removes all colors. Text attributes are kept.
+	ColorProfileNone
+
+	// ColorProfileANSI supports 16 standard and bright colors.
+	ColorProfileANSI
+
+	// ColorProfileANSI256 supports 256 colors palette.
+	ColorProfileANSI256
+
+	// ColorProfileTrueColor supports 24-bit colors.
+	ColorProfileTrueColor
+)
+
+const (
+	ansi256Standard = 16
+	ansi256Cube     = 16
+	ansi256Gray     = 232
+	ansi256GrayLast = 255
+)
+
+var gColorProfile = DetectColorProfile() // nolint: gochecknoglobals
+
+var gCubeLevels = [...]int{0x00, 0x5f, 0x87, 0xaf, 0xd7, 0xff} // nolint: gochecknoglobals
+
+var gANSIColors = [...][3]int{ // nolint: gochecknoglobals
+	{0, 0, 0},
+	{205, 0, 0},
+	{0, 205, 0},
+	{205, 205, 0},
+	{0, 0, 238},
+	{205, 0, 205},
+	{0, 205, 205},
+	{229, 229, 229},
+	{127, 127, 127},
+	{255, 0, 0},
+	{0, 255, 0},
+	{255, 255, 0},
+	{92, 92, 255},
+	{255, 0, 255},
+	{0, 255, 255},
+	{255, 255, 255},
+}
+
+// ColorProfile defines terminal color profile.
+type ColorProfile int
+
+// String returns name of color profile.
+func (p ColorProfile) String() string {
+	switch p {
+	case ColorProfileAuto:
+		return "auto"
+	case ColorProfileNone:
+		return "none"
+	case ColorProfileANSI:
+		return "ansi"
+	case ColorProfileANSI256:
+		return "ansi256"
+	case ColorProfileTrueColor:
+		return "truecolor"
+	default:
+		return "unknown"
+	}
+}
+
+// DetectColorProfile returns terminal color profile detected from COLORTERM
+// and TERM environment variables. COLORTERM set to truecolor or 24bit and
+// TERM with truecolor, 24bit or direct suffix give ColorProfileTrueColor.
+// TERM with 256color suffix gives ColorProfileANSI256. TERM set to dumb gives
+// ColorProfileNone, unless escape sequences are forced by FORCE_ESCAPE_SEQUENCES
+// or CLICOLOR_FORCE, then it gives ColorProfileANSI. Other non-empty TERM
+// values give ColorProfileANSI.
+// Unset TERM gives ColorProfileTrueColor.
+func DetectColorProfile() ColorProfile {
+	term := strings.ToLower(os.Getenv(TermEnv))
+
+	switch strings.ToLower(os.Getenv(ColorTermEnv)) {
+	case "truecolor", "24bit":
+		return ColorProfileTrueColor
+	}
+
+	switch {
+	case strings.HasSuffix(term, "truecolor"), strings.HasSuffix(term, "24bit"), strings.HasSuffix(term, "direct"):
+		return ColorProfileTrueColor
+	case strings.HasSuffix(term, "256color"):
+		return ColorProfileANSI256
+	case term == "dumb":
+		if decision, ok := detectEscapeSequencesEnv(); ok && decision.Enabled {
+			return ColorProfileANSI
+		}
+
+		return ColorProfileNone
+	case term != "":
+		return ColorProfileANSI
+	default:
+		return ColorProfileTrueColor
+	}
+}
+
+// toANSI256 returns the nearest color from 6x6x6 color cube or grayscale
+// ramp of 256 colors palette.
+func toANSI256(red, green, blue int) int {
+	r, g, b := toCubeLevel(red), toCubeLevel(green), toCubeLevel(blue)
+	cube := ansi256Cube + 36*r + 6*g + b
+	cubeDistance := distance(red, green, blue, gCubeLevels[r], gCubeLevels[g], gCubeLevels[b])
+
+	gray := ((red+green+blue)/3 - 3) / 10
+
+	if gray < 0 {
+		gray = 0
+	}
+
+	if gray > ansi256GrayLast-ansi256Gray {
+		gray = ansi256GrayLast - ansi256Gray
+	}
+
+	level := 8 + 10*gray
+
+	if distance(red, green, blue, level, level, level) < cubeDistance {
+		return ansi256Gray + gray
+	}
+
+	return cube
+}
+
+// toANSI returns index of the nearest color from 16 standard and bright colors.
+func toANSI(red, green, blue int) int {
+	nearest := 0
+	nearestDistance := -1
+
+	for index, color := range gANSIColors {
+		if d := distance(red, green, blue, color[0], color[1], color[2]); (nearestDistance < 0) || (d < nearestDistance) {
+			nearest, nearestDistance = index, d
+		}
+	}
+
+	return nearest
+}
+
+// fromANSI256 returns RGB values of color from 256 colors palette.
+func fromANSI256(index int) (red, green, blue int) {
+	switch {
+	case index < ansi256Standard:
+		color := gANSIColors[index]
+		return color[0], color[1], color[2]
+	case index < ansi256Gray:
+		index -= ansi256Cube
+		return gCubeLevels[index/36], gCubeLevels[(index/6)%6], gCubeLevels[index%6]
+	default:
+		level := 8 + 10*(index-ansi256Gray)
+		return level, level, level
+	}
+}
+
+func toCubeLevel(value int) int {
+	switch {
+	case value < 48:
+		return 0
+	case value < 115:
+		return 1
+	default:
+		return (value - 35) / 40
+	}
+}
+
+func distance(r1, g1, b1, r2, g2, b2 int) int {
+	return (r1-r2)*(r1-r2) + (g1-g2)*(g1-g2) + (b1-b2)*(b1-b2)
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"context"
+	"reflect"
+)
+
+var gContextType = reflect.TypeOf((*context.Context)(nil)).Elem() // nolint: gochecknoglobals
+
+// getContextValue returns value from context associated with key.
+func getContextValue(ctx context.Context, key interface{}) interface{} {
+	return ctx.Value(key)
+}
+
+// takesContext returns true if function takes context as the first parameter.
+func takesContext(function interface{}) bool {
+	t := reflect.TypeOf(function)
+
+	return (t != nil) && (t.Kind() == reflect.Func) && (t.NumIn() > 0) && (t.In(0) == gContextType)
+}
+
+// bindContext returns function without the first context parameter that
+// calls provided function with context.
+func bindContext(ctx context.Context, function interface{}) interface{} {
+	value := reflect.ValueOf(function)
+	t := value.Type()
+
+	in := make([]reflect.Type, 0, t.NumIn()-1)
+	out := make([]reflect.Type, 0, t.NumOut())
+
+	for i := 1; i < t.NumIn(); i++ {
+		in = append(in, t.In(i))
+	}
+
+	for i := 0; i < t.NumOut(); i++ {
+		out = append(out, t.Out(i))
+	}
+
+	return reflect.MakeFunc(reflect.FuncOf(in, out, t.IsVariadic()), func(arguments []reflect.Value) []reflect.Value {
+		arguments = append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, arguments...)
+
+		if t.IsVariadic() {
+			return value.CallSlice(arguments)
+		}
+
+		return value.Call(arguments)
+	}).Interface()
+}
@@ -21,6 +21,35 @@ Simple example:
 
 	formatted, err := formatter.Format("{italic}{red}{blink}blinky :){blink | off} no blinky :({default}")
 
+Escaping delimiters
+
+Doubled delimiters outside of replacement fields produce literal delimiters,
+like in Python. It also works with custom delimiters set by SetDelimiters:
+
+	formatted, err := formatter.Format(`{{"key": {p}}}`, 5) // {"key": 5}
+
+Format specification
+
+Replacement fields can contain format specification after colon, like in Python:
+
+	formatted, err := formatter.Format("{p:>10} {p0:08.3f} {name:^20} {p:x} {p:,} {p:e}", ...)
+
+Format specification syntax:
+
+	[[fill]align][sign][#][0][width][grouping][.precision][type]
+
+	fill       - Any character used for padding. Default is space
+	align      - Alignment: < (left), > (right), ^ (center), = (padding after sign)
+	sign       - Sign: + (always), - (only negative, default), space (space for positive)
+	#          - Alternate form, adds 0b, 0o, 0x or 0X prefix for integers
+	0          - Sign-aware zero padding
+	width      - Minimum field width
+	grouping   - Thousands separator: , or _
+	precision  - Digits after decimal point for floats or maximum field size for strings
+	type       - Presentation type: b, c, d, o, x, X, n for integers, e, E, f, F, g, G, % for floats, s for strings
+
+Empty placeholder before colon is an automatic placeholder: {:>10} is the same as {p:>10}.
+
 Built-in text functions
 
 List of built-in functions:
@@ -38,6 +67,8 @@ List of built-in functions:
 	hide       - Hide text
 	strike     - Strike text
 	off        - Disable specific text attribute. Example: blink | off
+	link       - OSC 8 hyperlink, 1 or 2 arguments, URL and optional text. Example: link "https://go.dev" "Go".
+	             Without escape sequences it gives "text (URL)" or URL only
 
 Built-in string functions
 
@@ -60,17 +91,41 @@ List of built-in functions:
 	cyan       - Cyan color
 	white      - White color
 	gray       - Gray color
-	rgb        - 24-bit color, 3 arguments (red, green, blue), integer values between 0-255
-	color      - Set color, 1 argument, color name like "red" or RGB HEX value in "0xXXXXXX" format
-	bright     - Make color bright, used with standard color function. Example: green | bright
+	rgb        - 24-bit color, 3 arguments (red, green, blue), integer values between 0-255.
+	             Mapped to the nearest color supported by color profile
+	ansi256    - 256 colors palette, 1 argument, integer index between 0-255
+	color      - Set color, 1 argument, color name like "red", CSS/X11 color name like "tomato",
+	             RGB HEX value in "0xRRGGBB", "#RGB" or "#RRGGBB" format, "rgb(R, G, B)",
+	             "hsl(H, S%, L%)" or 256 colors palette index in "ansi256(N)" format
+	bright     - Make color bright, used with standard color function or ansi256 index 0-7.
+	             Example: green | bright
 	foreground - Set as foreground color (default). Example: blue | foreground
 	background - Set as background color. Example: cyan | background
+	style      - Set named style, 1 argument, style name. Example: style "error"
+	endStyle   - End style and restore enclosing styles, the {end} action that closes style scope is translated to it
+
+Style scopes
+
+Colors, text attributes and named styles used without arguments open style scope
+closed by {end}. Closing scope restores enclosing styles:
+
+	{red}Error in {bold}{p}{end} module{end}
+
+Used with arguments they style only provided text: {red "text"} or {p | red}.
+The reset, normal and default functions close all opened style scopes.
+Inside if, range and with blocks {end} closes the block, styles used there do
+not open scope and {endStyle} restores enclosing styles:
+
+	{range p}{bold}{.}{endStyle}{end}
 
 Built-in OS functions
 
 List of built-in functions:
 
-	ip         - Get outbound (local) IP address
+	ip         - Get IP address of local network interface, optional arguments: v4 or v6 family,
+	             global, link-local or loopback scope and interface name. Example: ip "v6" "eth0"
+	ips        - Get all IP addresses of local network interfaces, the same arguments as ip
+	mac        - Get hardware address of local network interface, the same arguments as ip
 	user       - Get current user name
 	executable - Get current executable path
 	cwd        - Get current working directory path
@@ -85,6 +140,28 @@ List of built-in functions:
 	ppid       - Get parent process ID
 	bell       - Make a sound
 
+Sandboxed formatter
+
+Formatter created by NewSandboxed or configured by SetCapabilities allows only
+selected built-in functions. The ip function requires CapabilityNetwork, the env
+and expand functions require CapabilityEnv and other OS functions and the absolute
+path function require CapabilityOS. Message referencing disallowed function
+returns ErrNotAllowed error.
+
+Environment variables
+
+The env and expand functions read environment variables from source set by
+SetEnvironment, process environment by default. SetEnvPolicy allows or denies
+variables using glob patterns like AWS_*. Values of secret-like variables
+matching DefaultRedactPatterns are replaced by RedactedValue.
+
+Execution limits
+
+Formatter configured by SetLimits limits output size, execution time, nesting
+depth of if, range and with blocks and total number of range iterations.
+Exceeding limit returns ErrOutputLimit, ErrTimeLimit, ErrDepthLimit or
+ErrRangeLimit error.
+
 Built-in time functions
 
 List of built-in functions:
@@ -110,5 +187,18 @@ List of built-in functions:
 	fields    - Print also struct field names for given object. Example: p | fields
 	json      - Marshal object to JSON. Example: p | json
 	indent    - Indent marshaled JSON. Example: p | json | indent
+	format    - Format value using format specification. Example: p | format ">10"
+
+Context
+
+Messages formatted by FormatContext or FormatWriterContext stop with error when
+context is canceled or its deadline is exceeded. Custom functions that take
+context.Context as the first parameter are called with provided context:
+
+	f.AddFunction("tenant", func(ctx context.Context) string { ... })
+
+List of built-in functions:
+
+	ctx       - Get context value for key. Example: ctx "trace"
 */
 package formatter
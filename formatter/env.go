@@ -0,0 +1,213 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// RedactedValue replaces values of redacted environment variables.
+const RedactedValue = "[REDACTED]"
+
+// gRedactSegments defines segments of secret-like environment variable
+// names separated by underscores.
+var gRedactSegments = [...]string{ // nolint: gochecknoglobals
+	"SECRET",
+	"SECRETS",
+	"PASSWORD",
+	"PASSWD",
+	"TOKEN",
+	"KEY",
+	"APIKEY",
+	"CREDENTIAL",
+	"CREDENTIALS",
+	"PRIVATE",
+	"AUTH",
+	"COOKIE",
+}
+
+var gDefaultRedactPatterns = getRedactPatterns() // nolint: gochecknoglobals
+
+// Environment defines source of environment variables used by env and
+// expand functions. It returns variable value and true if it is present.
+type Environment func(name string) (string, bool)
+
+// EnvPolicy defines environment variables available to env and expand
+// functions. Patterns use path.Match syntax like AWS_* and they are
+// matched case-insensitively. Zero value allows all variables and redacts
+// variables matching DefaultRedactPatterns.
+type EnvPolicy struct {
+	// Allow lists allowed variables. Empty list allows all variables.
+	Allow []string
+
+	// Deny lists denied variables. It takes precedence over Allow. Variable
+	// not allowed or denied returns ErrEnvNotAllowed error.
+	Deny []string
+
+	// Redact lists variables with value replaced by RedactedValue in
+	// addition to DefaultRedactPatterns.
+	Redact []string
+
+	// DisableDefaultRedact disables redaction of DefaultRedactPatterns.
+	DisableDefaultRedact bool
+}
+
+// DefaultRedactPatterns returns glob patterns of secret-like environment
+// variable names redacted by default. Patterns match whole segments of names
+// separated by underscores like *_TOKEN or *_KEY_*, so that names like
+// KEYBOARD_LAYOUT or AUTHOR are not redacted.
+func DefaultRedactPatterns() []string {
+	return append([]string(nil), gDefaultRedactPatterns...)
+}
+
+// MapEnvironment returns environment source with variables from map.
+// It is useful in tests that should not depend on process environment.
+func MapEnvironment(variables map[string]string) Environment {
+	cloned := make(map[string]string, len(variables))
+
+	for name, value := range variables {
+		cloned[name] = value
+	}
+
+	return func(name string) (string, bool) {
+		value, ok := cloned[name]
+		return value, ok
+	}
+}
+
+// clone returns a deep copy of policy.
+func (p EnvPolicy) clone() EnvPolicy {
+	p.Allow = append([]string(nil), p.Allow...)
+	p.Deny = append([]string(nil), p.Deny...)
+	p.Redact = append([]string(nil), p.Redact...)
+
+	return p
+}
+
+// lookup returns value of environment variable allowed by policy.
+func (p *EnvPolicy) lookup(environment Environment, name string) (string, error) {
+	allowed := len(p.Allow) == 0
+
+	if !allowed {
+		matched, err := matchEnv(p.Allow, name)
+
+		if err != nil {
+			return "", err
+		}
+
+		allowed = matched
+	}
+
+	denied, err := matchEnv(p.Deny, name)
+
+	if err != nil {
+		return "", err
+	}
+
+	if !allowed || denied {
+		return "", fmt.Errorf("%w: %s", ErrEnvNotAllowed, strconv.Quote(name))
+	}
+
+	value, ok := environment(name)
+
+	if !ok {
+		return "", nil
+	}
+
+	redacted, err := matchEnv(p.Redact, name)
+
+	if (err == nil) && !redacted && !p.DisableDefaultRedact {
+		redacted, err = matchEnv(gDefaultRedactPatterns, name)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if redacted {
+		return RedactedValue, nil
+	}
+
+	return value, nil
+}
+
+// getEnvFunctions returns env and expand functions that read environment
+// variables from environment allowed by policy.
+func getEnvFunctions(environment Environment, policy EnvPolicy) template.FuncMap {
+	if environment == nil {
+		environment = os.LookupEnv
+	}
+
+	return template.FuncMap{
+		"env": func(name string) (string, error) {
+			return policy.lookup(environment, name)
+		},
+		"expand": func(text string) (string, error) {
+			var err error
+
+			expanded := os.Expand(text, func(name string) string {
+				value, lerr := policy.lookup(environment, name)
+
+				if (lerr != nil) && (err == nil) {
+					err = lerr
+				}
+
+				return value
+			})
+
+			if err != nil {
+				return "", err
+			}
+
+			return expanded, nil
+		},
+	}
+}
+
+// getRedactPatterns returns patterns that match redacted segments as whole
+// name, at the beginning, at the end or in the middle of name.
+func getRedactPatterns() []string {
+	patterns := make([]string, 0, 4*len(gRedactSegments))
+
+	for _, segment := range gRedactSegments {
+		patterns = append(patterns, segment, segment+"_*", "*_"+segment, "*_"+segment+"_*")
+	}
+
+	return patterns
+}
+
+// matchEnv returns true if environment variable name matches any pattern.
+func matchEnv(patterns []string, name string) (bool, error) {
+	name = strings.ToUpper(name)
+
+	for _, pattern := range patterns {
+		matched, err := path.Match(strings.ToUpper(pattern), name)
+
+		if err != nil {
+			return false, fError("invalid environment variable pattern " + strconv.Quote(pattern))
+		}
+
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -14,8 +14,305 @@
 
 package formatter
 
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// These errors can be used with errors.Is to check what went wrong.
+const (
+	ErrParse         = fError("parse error")
+	ErrExecute       = fError("execute error")
+	ErrFunction      = fError("function error")
+	ErrWriter        = fError("writer error")
+	ErrUndefined     = fError("placeholder or function is not defined")
+	ErrMissing       = fError("argument is missing")
+	ErrUnused        = fError("argument is not used")
+	ErrNotAllowed    = fError("function is not allowed")
+	ErrOutputLimit   = fError("output limit exceeded")
+	ErrTimeLimit     = fError("execution time limit exceeded")
+	ErrDepthLimit    = fError("nesting depth limit exceeded")
+	ErrRangeLimit    = fError("range iterations limit exceeded")
+	ErrEnvNotAllowed = fError("environment variable is not allowed")
+)
+
+// These constants define kinds of errors returned by formatter.
+const (
+	ParseError ErrorKind = iota
+	ExecuteError
+	FunctionError
+	WriterError
+)
+
+var gErrorLocation = regexp.MustCompile(`^template: [^:]*:(\d+)(?::(\d+))?: `) // nolint: gochecknoglobals
+
+var gErrorContext = regexp.MustCompile(`^executing "[^"]*" at <(.*?)>: `) // nolint: gochecknoglobals
+
+var gErrorFunction = regexp.MustCompile(`^error calling ([^:]+): `) // nolint: gochecknoglobals
+
+// ErrorKind defines kind of error returned by formatter.
+type ErrorKind int
+
+// FormatError defines error returned by formatter. It provides location in
+// original message and name of placeholder or function that caused error.
+// Offset is a byte offset in original message. Line and Column start from 1.
+// Offset is -1 and Column is 0 when location is unknown.
+type FormatError struct {
+	Kind        ErrorKind
+	Message     string
+	Description string
+	Name        string
+	Offset      int
+	Line        int
+	Column      int
+	Err         error
+}
+
 type fError string
 
 func (f fError) Error() string {
 	return string(f)
 }
+
+// String returns name of error kind.
+func (k ErrorKind) String() string {
+	switch k {
+	case ParseError:
+		return "parse"
+	case ExecuteError:
+		return "execute"
+	case FunctionError:
+		return "function"
+	case WriterError:
+		return "writer"
+	default:
+		return "unknown"
+	}
+}
+
+// Error returns error message.
+func (e *FormatError) Error() string {
+	var builder strings.Builder
+
+	builder.WriteString("formatter: " + e.Kind.String() + " error")
+
+	if e.Line > 0 {
+		builder.WriteString(" at " + strconv.Itoa(e.Line))
+	}
+
+	if e.Column > 0 {
+		builder.WriteString(":" + strconv.Itoa(e.Column))
+	}
+
+	if e.Name != "" {
+		builder.WriteString(" in " + strconv.Quote(e.Name))
+	}
+
+	if e.Description != "" {
+		builder.WriteString(": " + e.Description)
+	}
+
+	return builder.String()
+}
+
+// Unwrap returns underlying error.
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the sentinel error matching error kind.
+func (e *FormatError) Is(target error) bool {
+	switch target {
+	case ErrParse:
+		return e.Kind == ParseError
+	case ErrExecute:
+		return e.Kind == ExecuteError
+	case ErrFunction:
+		return e.Kind == FunctionError
+	case ErrWriter:
+		return e.Kind == WriterError
+	default:
+		return false
+	}
+}
+
+func newWriterError(message string, err error) *FormatError {
+	if limit := getLimitError(err); limit != nil {
+		return newLimitError(message, limit)
+	}
+
+	return &FormatError{
+		Kind:        WriterError,
+		Message:     message,
+		Description: err.Error(),
+		Offset:      -1,
+		Err:         err,
+	}
+}
+
+func newUndefinedError(c *compiled, name string, offset int) *FormatError {
+	e := &FormatError{
+		Kind:        ExecuteError,
+		Message:     c.message,
+		Description: ErrUndefined.Error(),
+		Name:        name,
+		Err:         ErrUndefined,
+	}
+
+	e.locate(c, offset)
+
+	return e
+}
+
+func newNotAllowedError(c *compiled, name string, offset int) *FormatError {
+	e := &FormatError{
+		Kind:        ExecuteError,
+		Message:     c.message,
+		Description: ErrNotAllowed.Error(),
+		Name:        name,
+		Err:         ErrNotAllowed,
+	}
+
+	e.locate(c, offset)
+
+	return e
+}
+
+func newDepthError(c *compiled, offset int) *FormatError {
+	e := &FormatError{
+		Kind:        ParseError,
+		Message:     c.message,
+		Description: ErrDepthLimit.Error(),
+		Err:         ErrDepthLimit,
+	}
+
+	e.locate(c, offset)
+
+	return e
+}
+
+func newLimitError(message string, err error) *FormatError {
+	return &FormatError{
+		Kind:        ExecuteError,
+		Message:     message,
+		Description: err.Error(),
+		Offset:      -1,
+		Err:         err,
+	}
+}
+
+func newUnusedError(message, name string) *FormatError {
+	return &FormatError{
+		Kind:        ExecuteError,
+		Message:     message,
+		Description: ErrUnused.Error(),
+		Name:        name,
+		Offset:      -1,
+		Err:         ErrUnused,
+	}
+}
+
+func newParseError(c *compiled, err error) *FormatError {
+	e := &FormatError{
+		Kind:    ParseError,
+		Message: c.message,
+		Offset:  -1,
+		Err:     err,
+	}
+
+	e.describe(c, err.Error())
+
+	return e
+}
+
+func newExecuteError(c *compiled, err error) *FormatError {
+	var execError template.ExecError
+
+	if limit := getLimitError(err); limit != nil {
+		return newLimitError(c.message, limit)
+	}
+
+	if !errors.As(err, &execError) {
+		return newWriterError(c.message, err)
+	}
+
+	e := &FormatError{
+		Kind:    ExecuteError,
+		Message: c.message,
+		Offset:  -1,
+		Err:     err,
+	}
+
+	e.describe(c, execError.Err.Error())
+
+	if match := gErrorContext.FindStringSubmatch(e.Description); match != nil {
+		e.Name = match[1]
+		e.Description = e.Description[len(match[0]):]
+	}
+
+	if match := gErrorFunction.FindStringSubmatch(e.Description); match != nil {
+		if cause := errors.Unwrap(execError.Err); cause != nil {
+			e.Kind = FunctionError
+			e.Name = match[1]
+
+			if e.Name == formatFunction {
+				e.Name = "format"
+			}
+
+			if errors.Is(cause, ErrMissing) {
+				e.Kind = ExecuteError
+			}
+
+			e.Description = e.Description[len(match[0]):]
+			e.Err = cause
+		}
+	}
+
+	return e
+}
+
+// describe sets error description and location from text/template error message.
+func (e *FormatError) describe(c *compiled, message string) {
+	match := gErrorLocation.FindStringSubmatch(message)
+
+	if match == nil {
+		e.Description = message
+		return
+	}
+
+	e.Description = message[len(match[0]):]
+	e.Line, _ = strconv.Atoi(match[1])
+
+	if match[2] == "" {
+		return
+	}
+
+	column, _ := strconv.Atoi(match[2])
+	offset := 0
+
+	for line := e.Line; line > 1; line-- {
+		next := strings.IndexByte(c.text[offset:], '\n')
+
+		if next < 0 {
+			break
+		}
+
+		offset += next + 1
+	}
+
+	if offset += column; offset > len(c.text) {
+		offset = len(c.text)
+	}
+
+	e.locate(c, offset)
+}
+
+// locate sets error location in original message from offset in rewritten text.
+func (e *FormatError) locate(c *compiled, offset int) {
+	e.Offset = position(c.spans, offset)
+	e.Line = 1 + strings.Count(c.message[:e.Offset], "\n")
+	e.Column = 1 + e.Offset - (strings.LastIndexByte(c.message[:e.Offset], '\n') + 1)
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	escape                = '\033'
+	bell                  = '\a'
+	zeroWidthJoiner       = '\u200D'
+	emojiPresentation     = '\uFE0F'
+	regionalIndicator     = '\U0001F1E6'
+	regionalIndicatorLast = '\U0001F1FF'
+)
+
+// gWideRunes defines ranges of East Asian wide, fullwidth and emoji
+// characters that take two columns in terminal.
+var gWideRunes = [...][2]rune{ // nolint: gochecknoglobals
+	{0x1100, 0x115F}, {0x231A, 0x231B}, {0x2329, 0x232A}, {0x23E9, 0x23EC},
+	{0x23F0, 0x23F0}, {0x23F3, 0x23F3}, {0x25FD, 0x25FE}, {0x2614, 0x2615},
+	{0x2648, 0x2653}, {0x267F, 0x267F}, {0x2693, 0x2693}, {0x26A1, 0x26A1},
+	{0x26AA, 0x26AB}, {0x26BD, 0x26BE}, {0x26C4, 0x26C5}, {0x26CE, 0x26CE},
+	{0x26D4, 0x26D4}, {0x26EA, 0x26EA}, {0x26F2, 0x26F3}, {0x26F5, 0x26F5},
+	{0x26FA, 0x26FA}, {0x26FD, 0x26FD}, {0x2705, 0x2705}, {0x270A, 0x270B},
+	{0x2728, 0x2728}, {0x274C, 0x274C}, {0x274E, 0x274E}, {0x2753, 0x2755},
+	{0x2757, 0x2757}, {0x2795, 0x2797}, {0x27B0, 0x27B0}, {0x27BF, 0x27BF},
+	{0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55}, {0x2E80, 0x303E},
+	{0x3041, 0x33FF}, {0x3400, 0x4DBF}, {0x4E00, 0x9FFF}, {0xA000, 0xA4CF},
+	{0xA960, 0xA97F}, {0xAC00, 0xD7A3}, {0xF900, 0xFAFF}, {0xFE10, 0xFE19},
+	{0xFE30, 0xFE6F}, {0xFF00, 0xFF60}, {0xFFE0, 0xFFE6}, {0x16FE0, 0x16FE4},
+	{0x17000, 0x18AFF}, {0x1B000, 0x1B2FF}, {0x1F004, 0x1F004}, {0x1F0CF, 0x1F0CF},
+	{0x1F18E, 0x1F18E}, {0x1F191, 0x1F19A}, {0x1F1E6, 0x1F1FF}, {0x1F200, 0x1F202},
+	{0x1F210, 0x1F23B}, {0x1F240, 0x1F248}, {0x1F250, 0x1F251}, {0x1F260, 0x1F265},
+	{0x1F300, 0x1F320}, {0x1F32D, 0x1F335}, {0x1F337, 0x1F37C}, {0x1F37E, 0x1F393},
+	{0x1F3A0, 0x1F3CA}, {0x1F3CF, 0x1F3D3}, {0x1F3E0, 0x1F3F0}, {0x1F3F4, 0x1F3F4},
+	{0x1F3F8, 0x1F43E}, {0x1F440, 0x1F440}, {0x1F442, 0x1F4FC}, {0x1F4FF, 0x1F53D},
+	{0x1F54B, 0x1F54E}, {0x1F550, 0x1F567}, {0x1F57A, 0x1F57A}, {0x1F595, 0x1F596},
+	{0x1F5A4, 0x1F5A4}, {0x1F5FB, 0x1F64F}, {0x1F680, 0x1F6C5}, {0x1F6CC, 0x1F6CC},
+	{0x1F6D0, 0x1F6D2}, {0x1F6D5, 0x1F6D7}, {0x1F6EB, 0x1F6EC}, {0x1F6F4, 0x1F6FC},
+	{0x1F7E0, 0x1F7EB}, {0x1F90C, 0x1F93A}, {0x1F93C, 0x1F945}, {0x1F947, 0x1F9FF},
+	{0x1FA70, 0x1FAFF}, {0x20000, 0x2FFFD}, {0x30000, 0x3FFFD},
+}
+
+// StripEscapeSequences returns text without ANSI escape sequences. It removes
+// CSI sequences like SGR colors and text attributes, OSC sequences like
+// hyperlinks and other escape sequences.
+func StripEscapeSequences(text string) string {
+	if strings.IndexByte(text, escape) < 0 {
+		return text
+	}
+
+	var builder strings.Builder
+
+	builder.Grow(len(text))
+
+	for {
+		start, end := findEscapeSequence(text)
+
+		if start < 0 {
+			builder.WriteString(text)
+			break
+		}
+
+		builder.WriteString(text[:start])
+		text = text[end:]
+	}
+
+	return builder.String()
+}
+
+// VisibleWidth returns number of terminal columns taken by text. ANSI escape
+// sequences and zero width characters like combining marks are not counted.
+// East Asian wide and fullwidth characters and emoji take two columns.
+// Emoji joined by zero width joiner and flags are counted as a single emoji.
+func VisibleWidth(text string) int {
+	width := 0
+	previous := 0
+	joined := false
+	flag := false
+
+	for _, r := range StripEscapeSequences(text) {
+		current := runeWidth(r)
+
+		switch {
+		case joined:
+			current = 0
+		case (r >= regionalIndicator) && (r <= regionalIndicatorLast):
+			if flag {
+				current = 0
+			}
+
+			flag = !flag
+		case (r == emojiPresentation) && (previous == 1):
+			current = 1
+		}
+
+		if (r < regionalIndicator) || (r > regionalIndicatorLast) {
+			flag = false
+		}
+
+		joined = r == zeroWidthJoiner
+		width += current
+
+		if current > 0 {
+			previous = current
+		}
+	}
+
+	return width
+}
+
+// findEscapeSequence returns start and end of the first escape sequence in
+// text. It returns -1 as start if text does not contain escape sequence.
+// Unterminated escape sequence ends at the end of text.
+func findEscapeSequence(text string) (start, end int) {
+	start = strings.IndexByte(text, escape)
+
+	if start < 0 {
+		return -1, -1
+	}
+
+	end = start + 1
+
+	if end >= len(text) {
+		return start, end
+	}
+
+	switch text[end] {
+	case '[':
+		return start, skipControlSequence(text, end+1)
+	case ']', 'P', 'X', '^', '_':
+		return start, skipControlString(text, end+1)
+	}
+
+	for (end < len(text)) && (text[end] >= 0x20) && (text[end] <= 0x2F) {
+		end++
+	}
+
+	if end < len(text) {
+		end++
+	}
+
+	return start, end
+}
+
+// skipControlSequence returns position just after CSI sequence parameters,
+// intermediate bytes and final byte.
+func skipControlSequence(text string, position int) int {
+	for position < len(text) {
+		c := text[position]
+		position++
+
+		if (c >= 0x40) && (c <= 0x7E) {
+			break
+		}
+	}
+
+	return position
+}
+
+// skipControlString returns position just after control string terminated
+// by BEL or string terminator ESC \.
+func skipControlString(text string, position int) int {
+	for position < len(text) {
+		switch text[position] {
+		case bell:
+			return position + 1
+		case escape:
+			if (position+1 < len(text)) && (text[position+1] == '\\') {
+				return position + 2
+			}
+
+			return position
+		}
+
+		position++
+	}
+
+	return position
+}
+
+// runeWidth returns number of terminal columns taken by single character.
+func runeWidth(r rune) int {
+	switch {
+	case (r < 0x20) || ((r >= 0x7F) && (r < 0xA0)):
+		return 0
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf), (r >= 0x1160) && (r <= 0x11FF):
+		return 0
+	case (r >= 0x1F3FB) && (r <= 0x1F3FF):
+		return 0
+	case r < gWideRunes[0][0]:
+		return 1
+	}
+
+	index := sort.Search(len(gWideRunes), func(i int) bool {
+		return gWideRunes[i][1] >= r
+	})
+
+	if (index < len(gWideRunes)) && (gWideRunes[index][0] <= r) {
+		return 2
+	}
+
+	return 1
+}
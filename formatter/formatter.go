@@ -16,17 +16,18 @@ package formatter
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"io"
-	"os"
 	"reflect"
-	"regexp"
-	"strconv"
-	"strings"
+	"sync"
 	"text/template"
 )
 
-var gEscapeSequences = AreEscapeSequencesSupported() // nolint: gochecknoglobals
+var gEscapeSequences = DetectEscapeSequences() // nolint: gochecknoglobals
+
+var gDefault = New() // nolint: gochecknoglobals
+
+var gDefaultMutex sync.RWMutex // nolint: gochecknoglobals
 
 // These constants define default values used by formatter.
 const (
@@ -44,59 +45,123 @@ type Functions map[string]interface{}
 
 // Formatter defines a formatter object that formats string using
 // “replacement fields” surrounded by curly braces {}.
+//
+// It is safe to use formatter from many goroutines, also when it is
+// configured concurrently. Every formatting uses a consistent snapshot of
+// configuration taken at the beginning. Template functions are stored using
+// copy-on-write, changing them never affects snapshots already taken.
 type Formatter struct {
+	mutex sync.RWMutex
+	config
+}
+
+type config struct {
 	placeholder     string
 	leftDelimiter   string
 	rightDelimiter  string
-	escapeSequences bool
+	escapeSequences EscapeSequencesMode
+	colorProfile    ColorProfile
+	strict          bool
+	unused          UnusedHandler
+	backend         Backend
+	renderer        StyleRenderer
+	capabilities    Capability
+	limits          Limits
+	environment     Environment
+	envPolicy       EnvPolicy
 	functions       Functions
+	theme           *Theme
+	variant         string
+	version         uint64
 }
 
 // New creates a new formatter object.
 func New() *Formatter {
 	return &Formatter{
-		placeholder:     DefaultPlaceholder,
-		leftDelimiter:   DefaultLeftDelimiter,
-		rightDelimiter:  DefaultRightDelimiter,
-		escapeSequences: gEscapeSequences,
-		functions:       Functions{},
+		config: newConfig(),
 	}
 }
 
-// Format formats string.
+// Format formats string using default formatter.
 func Format(message string, arguments ...interface{}) (string, error) {
-	return New().Format(message, arguments...)
+	return Default().Format(message, arguments...)
 }
 
 // MustFormat is like Format but panics if provided message cannot be formatted.
 // It simplifies safe initialization of global variables holding formatted strings.
 func MustFormat(message string, arguments ...interface{}) string {
-	return New().MustFormat(message, arguments...)
+	return Default().MustFormat(message, arguments...)
 }
 
-// FormatWriter formats string to writer.
+// FormatWriter formats string to writer using default formatter.
 func FormatWriter(writer io.Writer, message string, arguments ...interface{}) error {
-	return New().FormatWriter(writer, message, arguments...)
+	return Default().FormatWriter(writer, message, arguments...)
 }
 
-// AreEscapeSequencesSupported returns true if environment supports ANSI escape sequences.
-// Otherwise, it returns false.
-func AreEscapeSequencesSupported() bool {
-	switch strings.TrimSpace(strings.ToLower(os.Getenv(ForceEscapeSequencesEnv))) {
-	case "1", "true", "on", "yes", "enable", "y":
-		return true
-	case "0", "false", "off", "no", "disable", "n":
-		return false
-	default:
-		return (os.Getenv("TERM") != "dumb") && isTerminal()
+// FormatContext formats string with context using default formatter.
+// See Formatter.FormatContext.
+func FormatContext(ctx context.Context, message string, arguments ...interface{}) (string, error) {
+	return Default().FormatContext(ctx, message, arguments...)
+}
+
+// FormatWriterContext formats string to writer with context using default formatter.
+func FormatWriterContext(ctx context.Context, writer io.Writer, message string, arguments ...interface{}) error {
+	return Default().FormatWriterContext(ctx, writer, message, arguments...)
+}
+
+// FormatDual formats string using default formatter and returns both colored
+// and plain renderings of the same message. See Formatter.FormatDual.
+func FormatDual(message string, arguments ...interface{}) (colored, plain string, err error) {
+	return Default().FormatDual(message, arguments...)
+}
+
+// Compile parses message and returns a precompiled message using default formatter.
+func Compile(message string) (*Message, error) {
+	return Default().Compile(message)
+}
+
+// MustCompile is like Compile but panics if provided message cannot be parsed.
+// It simplifies safe initialization of global variables holding precompiled messages.
+func MustCompile(message string) *Message {
+	return Default().MustCompile(message)
+}
+
+// SetDefault sets default formatter used by package-level functions like
+// Format, MustFormat, FormatWriter, FormatDual, Compile and MustCompile.
+// Nil resets default formatter to a new formatter with default configuration.
+func SetDefault(formatter *Formatter) {
+	if formatter == nil {
+		formatter = New()
 	}
+
+	gDefaultMutex.Lock()
+	defer gDefaultMutex.Unlock()
+
+	gDefault = formatter
+}
+
+// Default returns default formatter used by package-level functions.
+// It can be configured in place, it is safe for concurrent use.
+func Default() *Formatter {
+	gDefaultMutex.RLock()
+	defer gDefaultMutex.RUnlock()
+
+	return gDefault
 }
 
 // Format formats string.
 func (f *Formatter) Format(message string, arguments ...interface{}) (string, error) {
+	return f.FormatContext(context.Background(), message, arguments...)
+}
+
+// FormatContext formats string with context. Formatting stops with error
+// when context is canceled or its deadline is exceeded. Custom functions
+// that take context.Context as the first parameter are called with provided
+// context, the built-in ctx function returns context value for key.
+func (f *Formatter) FormatContext(ctx context.Context, message string, arguments ...interface{}) (string, error) {
 	var buffer bytes.Buffer
 
-	if err := f.FormatWriter(&buffer, message, arguments...); err != nil {
+	if err := f.FormatWriterContext(ctx, &buffer, message, arguments...); err != nil {
 		return "", err
 	}
 
@@ -117,57 +182,98 @@ func (f *Formatter) MustFormat(message string, arguments ...interface{}) string
 
 // Reset resets formatter to default state.
 func (f *Formatter) Reset() *Formatter {
-	*f = *New()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.config = newConfig()
 
 	return f
 }
 
+// Clone returns a new formatter with a copy of configuration. Changing
+// configuration of cloned formatter does not affect original formatter.
+func (f *Formatter) Clone() *Formatter {
+	return &Formatter{
+		config: f.snapshot(),
+	}
+}
+
 // SetFunctions sets template functions used by formatter.
 func (f *Formatter) SetFunctions(functions Functions) *Formatter {
-	f.functions = functions
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.functions = functions.clone()
+	f.version = nextVersion()
+
 	return f
 }
 
 // GetFunction returns template function used by formatter.
 func (f *Formatter) GetFunction(name string) interface{} {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
 	return f.functions[name]
 }
 
-// GetFunctions returns template functions used by formatter.
+// GetFunctions returns a copy of template functions used by formatter.
 func (f *Formatter) GetFunctions() Functions {
-	return f.functions
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.functions.clone()
 }
 
 // AddFunction adds template function used by formatter.
 func (f *Formatter) AddFunction(name string, function interface{}) *Formatter {
-	f.functions[name] = function
-	return f
+	return f.AddFunctions(Functions{name: function})
 }
 
 // AddFunctions adds template functions used by formatter.
 func (f *Formatter) AddFunctions(functions Functions) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	cloned := f.functions.clone()
+
 	for name, function := range functions {
-		f.functions[name] = function
+		cloned[name] = function
 	}
 
+	f.functions = cloned
+	f.version = nextVersion()
+
 	return f
 }
 
 // RemoveFunction removes template function used by formatter.
 func (f *Formatter) RemoveFunction(name string) *Formatter {
-	if _, ok := f.functions[name]; !ok {
-		return f
-	}
-
-	delete(f.functions, name)
-
-	return f
+	return f.RemoveFunctions([]string{name})
 }
 
 // RemoveFunctions removes template functions used by formatter.
 func (f *Formatter) RemoveFunctions(names []string) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var cloned Functions
+
 	for _, name := range names {
-		f.RemoveFunction(name)
+		if _, ok := f.functions[name]; !ok {
+			continue
+		}
+
+		if cloned == nil {
+			cloned = f.functions.clone()
+		}
+
+		delete(cloned, name)
+	}
+
+	if cloned != nil {
+		f.functions = cloned
+		f.version = nextVersion()
 	}
 
 	return f
@@ -175,82 +281,311 @@ func (f *Formatter) RemoveFunctions(names []string) *Formatter {
 
 // ResetFunctions resets template functions used by formatter.
 func (f *Formatter) ResetFunctions() *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
 	f.functions = Functions{}
+	f.version = nextVersion()
+
+	return f
+}
+
+// SetCapabilities sets capabilities of built-in functions allowed by
+// formatter. Message referencing disallowed function returns ErrNotAllowed
+// error. Custom functions are always allowed, also these with the same name
+// as disallowed built-in function. Default is CapabilityAll.
+func (f *Formatter) SetCapabilities(capabilities Capability) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.capabilities = capabilities
+	f.version = nextVersion()
+
+	return f
+}
+
+// GetCapabilities returns capabilities of built-in functions allowed by formatter.
+func (f *Formatter) GetCapabilities() Capability {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.capabilities
+}
+
+// ResetCapabilities resets capabilities of built-in functions to default CapabilityAll.
+func (f *Formatter) ResetCapabilities() *Formatter {
+	return f.SetCapabilities(CapabilityAll)
+}
+
+// SetLimits sets limits of message execution like maximum output size,
+// execution time, nesting depth of blocks or number of range iterations.
+// Zero value of limit means no limit. Default is no limits.
+func (f *Formatter) SetLimits(limits Limits) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.limits = limits
+	f.version = nextVersion()
+
+	return f
+}
+
+// GetLimits returns limits of message execution.
+func (f *Formatter) GetLimits() Limits {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.limits
+}
+
+// ResetLimits resets limits of message execution to default no limits.
+func (f *Formatter) ResetLimits() *Formatter {
+	return f.SetLimits(Limits{})
+}
+
+// SetEnvironment sets source of environment variables used by env and
+// expand functions. Nil resets it to process environment. It is the default.
+func (f *Formatter) SetEnvironment(environment Environment) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.environment = environment
+	f.version = nextVersion()
+
+	return f
+}
+
+// GetEnvironment returns source of environment variables set by
+// SetEnvironment or nil.
+func (f *Formatter) GetEnvironment() Environment {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.environment
+}
+
+// ResetEnvironment resets source of environment variables to process environment.
+func (f *Formatter) ResetEnvironment() *Formatter {
+	return f.SetEnvironment(nil)
+}
+
+// SetEnvPolicy sets environment variables allowed, denied and redacted by
+// env and expand functions. See EnvPolicy.
+func (f *Formatter) SetEnvPolicy(policy EnvPolicy) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.envPolicy = policy.clone()
+	f.version = nextVersion()
+
+	return f
+}
+
+// GetEnvPolicy returns environment variables policy.
+func (f *Formatter) GetEnvPolicy() EnvPolicy {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.envPolicy.clone()
+}
+
+// ResetEnvPolicy resets environment variables policy to default that allows
+// all variables and redacts variables matching DefaultRedactPatterns.
+func (f *Formatter) ResetEnvPolicy() *Formatter {
+	return f.SetEnvPolicy(EnvPolicy{})
+}
+
+// SetTheme sets theme with named styles used by formatter. Named style can be
+// used as {style "name"} or {name} and ended with {end}. Names that are not
+// identifiers like log-error can be used only as {style "log-error"}.
+func (f *Formatter) SetTheme(theme *Theme) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.theme = theme.clone()
+	f.version = nextVersion()
+
 	return f
 }
 
+// GetTheme returns a copy of theme with named styles used by formatter.
+func (f *Formatter) GetTheme() *Theme {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.theme.clone()
+}
+
+// LoadTheme parses theme from reader using ParseTheme and sets it.
+func (f *Formatter) LoadTheme(reader io.Reader) error {
+	theme, err := ParseTheme(reader)
+
+	if err != nil {
+		return err
+	}
+
+	f.SetTheme(theme)
+
+	return nil
+}
+
+// ResetTheme removes all named styles used by formatter.
+func (f *Formatter) ResetTheme() *Formatter {
+	return f.SetTheme(nil)
+}
+
+// AddStyle adds named style to base styles of theme used by formatter.
+func (f *Formatter) AddStyle(name, style string) *Formatter {
+	return f.AddStyles(Styles{name: style})
+}
+
+// AddStyles adds named styles to base styles of theme used by formatter.
+func (f *Formatter) AddStyles(styles Styles) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	theme := f.theme.clone()
+
+	for name, style := range styles {
+		theme.Styles[name] = style
+	}
+
+	f.theme = theme
+	f.version = nextVersion()
+
+	return f
+}
+
+// GetStyle returns named style from selected variant or base styles.
+func (f *Formatter) GetStyle(name string) string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.theme.resolve(f.variant)[name]
+}
+
+// SetVariant selects variant of theme styles like dark or light.
+func (f *Formatter) SetVariant(variant string) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.variant = variant
+	f.version = nextVersion()
+
+	return f
+}
+
+// GetVariant returns selected variant of theme styles.
+func (f *Formatter) GetVariant() string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.variant
+}
+
+// ResetVariant resets selected variant of theme styles to base styles.
+func (f *Formatter) ResetVariant() *Formatter {
+	return f.SetVariant("")
+}
+
 // SetPlaceholder sets placeholder string prefix used for automatic and
 // positional placeholders to format string. Default is p.
 func (f *Formatter) SetPlaceholder(placeholder string) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
 	f.placeholder = placeholder
+
 	return f
 }
 
 // GetPlaceholder returns placeholder string prefix used for automatic and
 // positional placeholders to format string. Default is p.
 func (f *Formatter) GetPlaceholder() string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
 	return f.placeholder
 }
 
 // ResetPlaceholder resets placeholder to default value.
 func (f *Formatter) ResetPlaceholder() *Formatter {
-	f.placeholder = DefaultPlaceholder
-	return f
+	return f.SetPlaceholder(DefaultPlaceholder)
 }
 
 // SetDelimiters sets delimiters used by formatter. Default is {}.
 func (f *Formatter) SetDelimiters(left, right string) *Formatter {
-	return f.SetLeftDelimiter(left).SetRightDelimiter(right)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.leftDelimiter, f.rightDelimiter = left, right
+
+	return f
 }
 
 // SetLeftDelimiter sets left delimiter used by formatter. Default is {.
 func (f *Formatter) SetLeftDelimiter(delimiter string) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
 	f.leftDelimiter = delimiter
+
 	return f
 }
 
 // SetRightDelimiter sets right delimiter used by formatter. Default is }.
 func (f *Formatter) SetRightDelimiter(delimiter string) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
 	f.rightDelimiter = delimiter
+
 	return f
 }
 
 // GetDelimiters returns delimiters used by formatter. Default is {}.
 func (f *Formatter) GetDelimiters() (left, right string) {
-	return f.GetLeftDelimiter(), f.GetRightDelimiter()
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.leftDelimiter, f.rightDelimiter
 }
 
 // GetLeftDelimiter returns left delimiter used by formatter. Default is {.
 func (f *Formatter) GetLeftDelimiter() string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
 	return f.leftDelimiter
 }
 
 // GetRightDelimiter returns right delimiter used by formatter. Default is }.
 func (f *Formatter) GetRightDelimiter() string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
 	return f.rightDelimiter
 }
 
 // ResetDelimiters resets delimiters used by formatter to default values.
 func (f *Formatter) ResetDelimiters() *Formatter {
-	return f.ResetLeftDelimiter().ResetRightDelimiter()
+	return f.SetDelimiters(DefaultLeftDelimiter, DefaultRightDelimiter)
 }
 
 // ResetLeftDelimiter resets left delimiter used by formatter to default value.
 func (f *Formatter) ResetLeftDelimiter() *Formatter {
-	f.leftDelimiter = DefaultLeftDelimiter
-	return f
+	return f.SetLeftDelimiter(DefaultLeftDelimiter)
 }
 
 // ResetRightDelimiter resets right delimiter used by formatter to default value.
 func (f *Formatter) ResetRightDelimiter() *Formatter {
-	f.rightDelimiter = DefaultRightDelimiter
-	return f
+	return f.SetRightDelimiter(DefaultRightDelimiter)
 }
 
 // SetEscapeSequences enables or disables ANSI escape sequences in formatted messages.
+// It sets escape sequences mode to EscapeSequencesAlways or EscapeSequencesNever.
 func (f *Formatter) SetEscapeSequences(escapeSequences bool) *Formatter {
-	f.escapeSequences = escapeSequences
-	return f
+	return f.SetEscapeSequencesMode(getEscapeSequencesMode(escapeSequences))
 }
 
 // EnableEscapeSequences allows ANSI escape sequences in formatted messages.
@@ -264,98 +599,428 @@ func (f *Formatter) DisableEscapeSequences() *Formatter {
 }
 
 // AreEscapeSequencesEnabled returns true if escape sequences are allowed in formatted messages.
-// Otherwise, it returns false.
+// Otherwise, it returns false. In EscapeSequencesAuto mode it returns decision
+// used for writers without Fd() method.
 func (f *Formatter) AreEscapeSequencesEnabled() bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.escapeSequencesFor(nil).Enabled
+}
+
+// GetEscapeSequencesDecision returns decision about ANSI escape sequences in
+// messages formatted to writer with a reason. Writer can be nil.
+func (f *Formatter) GetEscapeSequencesDecision(writer io.Writer) EscapeSequencesDecision {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.escapeSequencesFor(writer)
+}
+
+// SetEscapeSequencesMode sets escape sequences mode. Use EscapeSequencesAuto
+// to detect support of ANSI escape sequences for destination writer.
+// Default is EscapeSequencesAlways or EscapeSequencesNever based on
+// AreEscapeSequencesSupported.
+func (f *Formatter) SetEscapeSequencesMode(mode EscapeSequencesMode) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.escapeSequences = mode
+
+	return f
+}
+
+// GetEscapeSequencesMode returns escape sequences mode.
+func (f *Formatter) GetEscapeSequencesMode() EscapeSequencesMode {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
 	return f.escapeSequences
 }
 
+// ResetEscapeSequencesMode resets escape sequences mode to default value.
+func (f *Formatter) ResetEscapeSequencesMode() *Formatter {
+	return f.SetEscapeSequencesMode(getEscapeSequencesMode(gEscapeSequences.Enabled))
+}
+
+// SetColorProfile sets color profile used by formatter. Colors are mapped to
+// the nearest color supported by color profile. Default is ColorProfileAuto.
+func (f *Formatter) SetColorProfile(profile ColorProfile) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.colorProfile = profile
+
+	return f
+}
+
+// GetColorProfile returns color profile used by formatter. It returns
+// detected color profile when color profile is set to ColorProfileAuto.
+func (f *Formatter) GetColorProfile() ColorProfile {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.getColorProfile()
+}
+
+// ResetColorProfile resets color profile to default ColorProfileAuto.
+func (f *Formatter) ResetColorProfile() *Formatter {
+	return f.SetColorProfile(ColorProfileAuto)
+}
+
+// SetStyleRenderer sets renderer used by built-in style functions like bold,
+// red, rgb or link and by named styles. Custom renderer is used regardless
+// of escape sequences mode, only backends always use ANSI escape sequences.
+// Nil resets renderer to ANSIStyleRenderer with color profile used by
+// formatter or to NoopStyleRenderer when ANSI escape sequences are disabled.
+// It is the default.
+func (f *Formatter) SetStyleRenderer(renderer StyleRenderer) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.renderer = renderer
+	f.version = nextVersion()
+
+	return f
+}
+
+// GetStyleRenderer returns renderer set by SetStyleRenderer or nil.
+func (f *Formatter) GetStyleRenderer() StyleRenderer {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.renderer
+}
+
+// ResetStyleRenderer resets renderer used by built-in style functions to
+// default ANSIStyleRenderer.
+func (f *Formatter) ResetStyleRenderer() *Formatter {
+	return f.SetStyleRenderer(nil)
+}
+
+// SetStrict enables or disables strict mode. In strict mode formatter returns
+// an error for unused arguments and for automatic placeholders used more
+// times than provided arguments. Undefined named and positional placeholders
+// are always reported as an error.
+func (f *Formatter) SetStrict(strict bool) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.strict = strict
+
+	return f
+}
+
+// EnableStrict enables strict mode.
+func (f *Formatter) EnableStrict() *Formatter {
+	return f.SetStrict(true)
+}
+
+// DisableStrict disables strict mode.
+func (f *Formatter) DisableStrict() *Formatter {
+	return f.SetStrict(false)
+}
+
+// IsStrict returns true if strict mode is enabled. Otherwise, it returns false.
+func (f *Formatter) IsStrict() bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.strict
+}
+
+// SetUnusedHandler sets handler called with arguments not used by formatted
+// message. Default is AppendUnused. Strict mode takes precedence over handler.
+func (f *Formatter) SetUnusedHandler(handler UnusedHandler) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.unused = handler
+
+	return f
+}
+
+// GetUnusedHandler returns handler called with arguments not used by formatted message.
+func (f *Formatter) GetUnusedHandler() UnusedHandler {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	if f.unused == nil {
+		return AppendUnused
+	}
+
+	return f.unused
+}
+
+// ResetUnusedHandler resets handler called with unused arguments to default AppendUnused.
+func (f *Formatter) ResetUnusedHandler() *Formatter {
+	return f.SetUnusedHandler(nil)
+}
+
+// SetBackend sets backend that renders formatted messages to other markup
+// like HTML. Backend gets message formatted with true color ANSI escape
+// sequences regardless of terminal, color profile and style renderer.
+// Nil removes backend, formatted messages contain ANSI escape sequences
+// allowed by escape sequences mode. It is the default.
+func (f *Formatter) SetBackend(backend Backend) *Formatter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.backend = backend
+
+	return f
+}
+
+// GetBackend returns backend that renders formatted messages or nil.
+func (f *Formatter) GetBackend() Backend {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.backend
+}
+
+// ResetBackend removes backend that renders formatted messages.
+func (f *Formatter) ResetBackend() *Formatter {
+	return f.SetBackend(nil)
+}
+
 // FormatWriter formats string to writer.
 func (f *Formatter) FormatWriter(writer io.Writer, message string, arguments ...interface{}) error {
-	var object interface{}
+	return f.FormatWriterContext(context.Background(), writer, message, arguments...)
+}
 
-	var objectPosition int
+// FormatWriterContext formats string to writer with context. See FormatContext.
+func (f *Formatter) FormatWriterContext(ctx context.Context, writer io.Writer, message string, arguments ...interface{}) error {
+	m, err := f.snapshot().message(message, writer)
 
-	used := make(map[int]bool)
-	placeholders := make(template.FuncMap)
-	placeholders[f.placeholder] = argumentAutomatic(used, arguments)
+	if err != nil {
+		return err
+	}
 
-	for position, argument := range arguments {
-		placeholder := f.placeholder + strconv.Itoa(position)
-		placeholders[placeholder] = argumentValue(used, position, argument)
-		valueOf := reflect.ValueOf(argument)
+	return m.FormatWriterContext(ctx, writer, arguments...)
+}
 
-		switch valueOf.Kind() {
-		case reflect.Map:
-			if reflect.TypeOf(argument).Key().Kind() == reflect.String {
-				for _, key := range valueOf.MapKeys() {
-					placeholders[key.String()] = argumentValue(used, position, valueOf.MapIndex(key).Interface())
-				}
-			}
-		case reflect.Struct:
-			object = argument
-			objectPosition = position
-		case reflect.Ptr:
-			if isObjectPointer(valueOf) {
-				object = argument
-				objectPosition = position
-			}
-		}
+// FormatDual formats string once and returns both colored rendering with
+// ANSI escape sequences and plain rendering without them. Colored rendering
+// contains escape sequences regardless of escape sequences mode. It is
+// useful to write the same message to terminal and to log file. With custom
+// style renderer colored rendering contains its markup and plain rendering
+// does not.
+func (f *Formatter) FormatDual(message string, arguments ...interface{}) (colored, plain string, err error) {
+	cfg := f.snapshot()
+
+	c, err := cfg.lookupDual(message)
+
+	if err != nil {
+		return "", "", err
 	}
 
-	t := template.New("").Delims(f.leftDelimiter, f.rightDelimiter).Funcs(f.getEscapeFunctions()).
-		Funcs(gFunctions).Funcs(placeholders).Funcs(template.FuncMap(f.functions))
+	m := &Message{
+		compiled: c,
+		config:   cfg,
+	}
 
-	if _, err := t.Parse(message); err != nil {
-		return err
+	return m.FormatDual(arguments...)
+}
+
+// Compile parses message and returns a precompiled message that can be
+// formatted many times with different arguments. It captures delimiters,
+// placeholder and functions used by formatter at compile time.
+func (f *Formatter) Compile(message string) (*Message, error) {
+	return f.snapshot().message(message, nil)
+}
+
+// MustCompile is like Compile but panics if provided message cannot be parsed.
+// It simplifies safe initialization of global variables holding precompiled messages.
+func (f *Formatter) MustCompile(message string) *Message {
+	m, err := f.Compile(message)
+
+	if err != nil {
+		panic(err)
 	}
 
-	if err := t.Execute(writer, object); err != nil {
-		return err
+	return m
+}
+
+// snapshot returns a copy of formatter configuration. Functions are never
+// modified in place, it is safe to use them without holding a lock.
+func (f *Formatter) snapshot() config {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.config
+}
+
+func newConfig() config {
+	return config{
+		placeholder:     DefaultPlaceholder,
+		leftDelimiter:   DefaultLeftDelimiter,
+		rightDelimiter:  DefaultRightDelimiter,
+		escapeSequences: getEscapeSequencesMode(gEscapeSequences.Enabled),
+		capabilities:    CapabilityAll,
+		functions:       Functions{},
 	}
+}
+
+// message returns a precompiled message for writer. Writer can be nil.
+func (cfg config) message(message string, writer io.Writer) (*Message, error) {
+	c, err := cfg.lookup(message, cfg.escapeSequencesFor(writer).Enabled)
 
-	if len(used) >= len(arguments) {
-		return nil
+	if err != nil {
+		return nil, err
 	}
 
-	if err := f.objectUsed(used, objectPosition, object, message); err != nil {
-		return err
+	return &Message{
+		compiled: c,
+		config:   cfg,
+	}, nil
+}
+
+// lookup returns parsed message from cache or parses it and adds it to cache.
+func (cfg *config) lookup(message string, escapeSequences bool) (*compiled, error) {
+	key := cacheKey{
+		message:         message,
+		leftDelimiter:   cfg.leftDelimiter,
+		rightDelimiter:  cfg.rightDelimiter,
+		placeholder:     cfg.placeholder,
+		escapeSequences: escapeSequences,
+		colorProfile:    cfg.getColorProfile(),
+		version:         cfg.version,
+	}
+
+	return cfg.lookupKey(key, cfg.getStyleRenderer(escapeSequences, key.colorProfile))
+}
+
+// lookupBackend returns parsed message for backend from cache or parses it
+// and adds it to cache. Backends parse ANSI escape sequences, message is
+// always rendered with true color profile regardless of terminal, color
+// profile and style renderer. Escape sequences are rendered by
+// backendRenderer, so that they can be told apart from formatted values.
+func (cfg *config) lookupBackend(message string) (*compiled, error) {
+	key := cacheKey{
+		message:         message,
+		leftDelimiter:   cfg.leftDelimiter,
+		rightDelimiter:  cfg.rightDelimiter,
+		placeholder:     cfg.placeholder,
+		escapeSequences: true,
+		target:          renderBackend,
+		colorProfile:    ColorProfileTrueColor,
+		version:         cfg.version,
+	}
+
+	return cfg.lookupKey(key, backendRenderer{})
+}
+
+// lookupDual returns parsed message for FormatDual from cache or parses it
+// and adds it to cache. Styles are rendered by dualRenderer, so that both
+// colored and plain renderings are created from the same formatted message.
+func (cfg *config) lookupDual(message string) (*compiled, error) {
+	key := cacheKey{
+		message:         message,
+		leftDelimiter:   cfg.leftDelimiter,
+		rightDelimiter:  cfg.rightDelimiter,
+		placeholder:     cfg.placeholder,
+		escapeSequences: true,
+		target:          renderDual,
+		colorProfile:    cfg.getColorProfile(),
+		version:         cfg.version,
 	}
 
-	separator := getSeparator(message)
-	message = ""
+	return cfg.lookupKey(key, dualRenderer{
+		renderer: cfg.getStyleRenderer(true, key.colorProfile),
+	})
+}
+
+func (cfg *config) lookupKey(key cacheKey, renderer StyleRenderer) (*compiled, error) {
+	c := gCache.get(key)
+
+	if c == nil {
+		var err error
 
-	for position, argument := range arguments {
-		if !used[position] {
-			message += separator + fmt.Sprint(argument)
-			separator = " "
+		if c, err = cfg.compile(key.message, key.escapeSequences, renderer); err != nil {
+			return nil, err
 		}
+
+		c.target = key.target
+
+		gCache.add(key, c)
 	}
 
-	return write(writer, message)
+	return c, nil
 }
 
-func (f *Formatter) getEscapeFunctions() template.FuncMap {
-	if f.escapeSequences {
-		return gEscapeFunctions
+func (cfg *config) compile(message string, escapeSequences bool, renderer StyleRenderer) (*compiled, error) {
+	functions := make(template.FuncMap)
+
+	resolved := cfg.theme.resolve(cfg.variant)
+	styles := getStyleFunctions(resolved, renderer)
+
+	for _, m := range []template.FuncMap{gFunctions, getEnvFunctions(cfg.environment, cfg.envPolicy)} {
+		for name, function := range m {
+			if isAllowed(name, cfg.capabilities) {
+				functions[name] = function
+			}
+		}
 	}
 
-	return gDummyFunctions
+	for _, m := range []template.FuncMap{getRendererFunctions(renderer), styles, template.FuncMap(cfg.functions)} {
+		for name, function := range m {
+			functions[name] = function
+		}
+	}
+
+	kinds := getStyleKinds(functions, resolved, cfg.functions)
+
+	c, err := compile(message, cfg.leftDelimiter, cfg.rightDelimiter, cfg.placeholder, functions, kinds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.guard(cfg.limits.MaxDepth); err != nil {
+		return nil, err
+	}
+
+	for _, m := range []template.FuncMap{styles, template.FuncMap(cfg.functions)} {
+		for name := range m {
+			c.functions[name] = true
+		}
+	}
+
+	c.escapeSequences = escapeSequences
+	c.renderer = renderer
+	c.capabilities = cfg.capabilities
+
+	return c, nil
 }
 
-func (f *Formatter) objectUsed(used map[int]bool, position int, object interface{}, message string) (err error) {
-	if (object == nil) || used[position] {
-		return nil
+func (cfg *config) getColorProfile() ColorProfile {
+	if cfg.colorProfile == ColorProfileAuto {
+		return gColorProfile
 	}
 
-	var r *regexp.Regexp
+	return cfg.colorProfile
+}
 
-	if r, err = regexp.Compile(f.leftDelimiter + `\s*(\.|[^\.].* \.).+` + f.rightDelimiter); err != nil {
-		return err
+func (cfg *config) getStyleRenderer(escapeSequences bool, profile ColorProfile) StyleRenderer {
+	switch {
+	case cfg.renderer != nil:
+		return cfg.renderer
+	case !escapeSequences:
+		return NoopStyleRenderer{}
+	default:
+		return ANSIStyleRenderer{Profile: profile}
 	}
+}
 
-	used[position] = r.MatchString(message)
+func (f Functions) clone() Functions {
+	cloned := make(Functions, len(f))
 
-	return nil
+	for name, function := range f {
+		cloned[name] = function
+	}
+
+	return cloned
 }
 
 func getSeparator(message string) string {
@@ -377,20 +1042,22 @@ func argumentValue(used map[int]bool, position int, argument interface{}) func()
 	}
 }
 
-func argumentAutomatic(used map[int]bool, arguments []interface{}) func() interface{} {
+func argumentAutomatic(used map[int]bool, arguments []interface{}, strict bool) func() (interface{}, error) {
 	length := len(arguments)
 	position := 0
 
-	return func() interface{} {
+	return func() (interface{}, error) {
 		var argument interface{}
 
 		if position < length {
 			used[position] = true
 			argument = arguments[position]
 			position++
+		} else if strict {
+			return nil, ErrMissing
 		}
 
-		return argument
+		return argument, nil
 	}
 }
 
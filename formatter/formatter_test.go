@@ -16,17 +16,24 @@ package formatter_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net"
 	"os"
 	"os/user"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/golang/mock/gomock"
 	"github.com/mattn/go-isatty"
 	"github.com/stretchr/testify/assert"
 	"gitlab.com/tymonx/go-formatter/formatter"
-	"gitlab.com/tymonx/go-formatter/mocks"
 )
 
 func ExampleMustFormat() {
@@ -540,35 +547,35 @@ func TestFormatterColors(test *testing.T) {
 }
 
 func TestFormatterRGB(test *testing.T) {
-	formatted, err := formatter.Format("{rgb 255 165 0}funky{normal}")
+	formatted, err := formatter.New().SetColorProfile(formatter.ColorProfileTrueColor).Format("{rgb 255 165 0}funky{normal}")
 
 	assert.NoError(test, err)
 	assert.Equal(test, "\x1b[38;2;255;165;0mfunky\x1b[0m", formatted)
 }
 
 func TestFormatterRGBBackground(test *testing.T) {
-	formatted, err := formatter.Format("{rgb 255 165 0 | background}funky{normal}")
+	formatted, err := formatter.New().SetColorProfile(formatter.ColorProfileTrueColor).Format("{rgb 255 165 0 | background}funky{normal}")
 
 	assert.NoError(test, err)
 	assert.Equal(test, "\x1b[48;2;255;165;0mfunky\x1b[0m", formatted)
 }
 
 func TestFormatterRGBBackgroundForeground(test *testing.T) {
-	formatted, err := formatter.Format("{rgb 0 165 7 | background | foreground}funky{normal}")
+	formatted, err := formatter.New().SetColorProfile(formatter.ColorProfileTrueColor).Format("{rgb 0 165 7 | background | foreground}funky{normal}")
 
 	assert.NoError(test, err)
 	assert.Equal(test, "\x1b[38;2;0;165;7mfunky\x1b[0m", formatted)
 }
 
 func TestFormatterRGBForeground(test *testing.T) {
-	formatted, err := formatter.Format("{rgb 255 165 0 | foreground}funky{normal}")
+	formatted, err := formatter.New().SetColorProfile(formatter.ColorProfileTrueColor).Format("{rgb 255 165 0 | foreground}funky{normal}")
 
 	assert.NoError(test, err)
 	assert.Equal(test, "\x1b[38;2;255;165;0mfunky\x1b[0m", formatted)
 }
 
 func TestFormatterRGBBackgroundBackground(test *testing.T) {
-	formatted, err := formatter.Format("{rgb 255 165 3 | background | background}funky{normal}")
+	formatted, err := formatter.New().SetColorProfile(formatter.ColorProfileTrueColor).Format("{rgb 255 165 3 | background | background}funky{normal}")
 
 	assert.NoError(test, err)
 	assert.Equal(test, "\x1b[48;2;255;165;3mfunky\x1b[0m", formatted)
@@ -791,6 +798,8 @@ func TestFormatterOffInvalid(test *testing.T) {
 	assert.Empty(test, formatted)
 }
 
+var getInterfaces = formatter.Interfaces // nolint: gochecknoglobals
+
 func TestFormatterIPAddress(test *testing.T) {
 	formatted, err := formatter.Format("{ip}")
 
@@ -798,66 +807,76 @@ func TestFormatterIPAddress(test *testing.T) {
 	assert.NotEmpty(test, formatted)
 }
 
-func TestFormatterIPAddressDialError(test *testing.T) {
+func TestFormatterIPAddressInterfaces(test *testing.T) {
 	defer func() {
-		formatter.Dial = net.Dial
+		formatter.Interfaces = getInterfaces
 	}()
 
-	controller := gomock.NewController(test)
-	defer controller.Finish()
+	formatter.Interfaces = func() ([]formatter.NetworkInterface, error) {
+		return []formatter.NetworkInterface{
+			{
+				Name:      "lo",
+				Addresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+			},
+			{
+				Name:         "eth0",
+				HardwareAddr: net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02},
+				Addresses:    []net.IP{net.ParseIP("fe80::42:acff:fe11:2"), net.ParseIP("2001:db8::2"), net.ParseIP("172.17.0.2")},
+			},
+			{
+				Name:      "wlan0",
+				Addresses: []net.IP{net.ParseIP("169.254.10.1"), net.ParseIP("ff02::1")},
+			},
+		}, nil
+	}
 
-	connection := mocks.NewMockConn(controller)
+	for _, tt := range []struct {
+		message string
+		expect  string
+	}{
+		{"{ip}", "172.17.0.2"},
+		{`{ip "v6"}`, "2001:db8::2"},
+		{`{ip "link-local"}`, "169.254.10.1"},
+		{`{ip "link-local" "IPv6"}`, "fe80::42:acff:fe11:2"},
+		{`{ip "loopback"}`, "127.0.0.1"},
+		{`{ip "lo" "v6"}`, "::1"},
+		{`{ip "wlan0"}`, "169.254.10.1"},
+		{"{ips}", "[172.17.0.2 2001:db8::2 169.254.10.1 fe80::42:acff:fe11:2 127.0.0.1 ::1]"},
+		{`{range ips "eth0" "v6"}{.};{end}`, "2001:db8::2;fe80::42:acff:fe11:2;"},
+		{"{mac}", "02:42:ac:11:00:02"},
+		{`{mac "eth0"}`, "02:42:ac:11:00:02"},
+	} {
+		formatted, err := formatter.Format(tt.message)
+
+		assert.NoError(test, err, tt.message)
+		assert.Equal(test, tt.expect, formatted, tt.message)
+	}
 
-	connection.EXPECT().Close().Times(1)
-	connection.EXPECT().LocalAddr().Times(1).Return(new(net.UDPAddr))
+	for _, message := range []string{`{ip "eth1"}`, `{ips "wlan0" "global"}`, `{mac "lo"}`} {
+		_, err := formatter.Format(message)
 
-	formatter.Dial = func(string, string) (net.Conn, error) {
-		return connection, Error("error")
+		assert.True(test, errors.Is(err, formatter.ErrFunction), message)
 	}
 
-	formatted, err := formatter.Format("{ip}")
-
-	assert.NoError(test, err)
-	assert.NotEmpty(test, formatted)
-}
+	_, err := formatter.Format(`{ip "eth1" "v6"}`)
 
-func TestFormatterIPAddressDialNil(test *testing.T) {
-	defer func() {
-		formatter.Dial = net.Dial
-	}()
+	assert.Equal(test, `formatter: function error at 1:2 in "ip": no IP address matching "eth1 v6" found`, err.Error())
 
-	formatter.Dial = func(string, string) (net.Conn, error) {
+	formatter.Interfaces = func() ([]formatter.NetworkInterface, error) {
 		return nil, Error("error")
 	}
 
-	formatted, err := formatter.Format("{ip}")
-
-	assert.NoError(test, err)
-	assert.NotEmpty(test, formatted)
-	assert.Equal(test, "127.0.0.1", formatted)
-}
-
-func TestFormatterIPAddressCloseError(test *testing.T) {
-	defer func() {
-		formatter.Dial = net.Dial
-	}()
-
-	controller := gomock.NewController(test)
-	defer controller.Finish()
+	_, err = formatter.Format("{ip}")
 
-	connection := mocks.NewMockConn(controller)
+	assert.True(test, errors.Is(err, formatter.ErrFunction))
 
-	connection.EXPECT().Close().Times(1).Return(Error("error"))
-	connection.EXPECT().LocalAddr().Times(1).Return(new(net.UDPAddr))
-
-	formatter.Dial = func(string, string) (net.Conn, error) {
-		return connection, nil
+	formatter.Interfaces = func() ([]formatter.NetworkInterface, error) {
+		return nil, nil
 	}
 
-	formatted, err := formatter.Format("{ip}")
+	_, err = formatter.Format("{ip}")
 
-	assert.NoError(test, err)
-	assert.NotEmpty(test, formatted)
+	assert.Equal(test, `formatter: function error at 1:2 in "ip": no IP address found`, err.Error())
 }
 
 func TestFormatterUser(test *testing.T) {
@@ -925,7 +944,7 @@ func TestFormatterColor(test *testing.T) {
 }
 
 func TestFormatterColorHex(test *testing.T) {
-	formatted, err := formatter.Format(`{color "0xF3AC67"}funky{normal}`)
+	formatted, err := formatter.New().SetColorProfile(formatter.ColorProfileTrueColor).Format(`{color "0xF3AC67"}funky{normal}`)
 
 	assert.NoError(test, err)
 	assert.Equal(test, "\x1b[38;2;243;172;103mfunky\x1b[0m", formatted)
@@ -1051,3 +1070,1823 @@ func TestFormatterJSONError(test *testing.T) {
 	assert.Error(test, err)
 	assert.Empty(test, formatted)
 }
+
+func TestFormatterCache(test *testing.T) {
+	formatter.ResetCache()
+
+	for i := 0; i < 3; i++ {
+		formatted, err := formatter.Format("{p} {p}", "cached", i)
+
+		assert.NoError(test, err)
+		assert.Equal(test, fmt.Sprintf("cached %d", i), formatted)
+	}
+
+	stats := formatter.GetCacheStats()
+
+	assert.Equal(test, uint64(2), stats.Hits)
+	assert.Equal(test, uint64(1), stats.Misses)
+	assert.Equal(test, 1, stats.Length)
+	assert.Equal(test, formatter.DefaultCacheSize, stats.Size)
+}
+
+func TestFormatterCacheSize(test *testing.T) {
+	defer formatter.SetCacheSize(formatter.DefaultCacheSize)
+
+	formatter.ResetCache()
+	formatter.SetCacheSize(1)
+
+	assert.Equal(test, 1, formatter.GetCacheSize())
+
+	for _, message := range []string{"{p}", "{p} {p}", "{p}"} {
+		_, err := formatter.Format(message, 1, 2)
+		assert.NoError(test, err)
+	}
+
+	stats := formatter.GetCacheStats()
+
+	assert.Equal(test, uint64(0), stats.Hits)
+	assert.Equal(test, uint64(3), stats.Misses)
+	assert.Equal(test, 1, stats.Length)
+
+	formatter.SetCacheSize(0)
+
+	formatted, err := formatter.Format("{p}", 3)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "3", formatted)
+	assert.Equal(test, 0, formatter.GetCacheStats().Length)
+	assert.Equal(test, uint64(3), formatter.GetCacheStats().Misses)
+}
+
+func TestFormatterCacheFunctions(test *testing.T) {
+	f := formatter.New().AddFunction("value", func() string { return "a" })
+
+	formatted, err := f.Format("{value}")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "a", formatted)
+
+	formatted, err = f.AddFunction("value", func() string { return "b" }).Format("{value}")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "b", formatted)
+
+	formatted, err = f.RemoveFunction("value").Format("{value}")
+
+	assert.Error(test, err)
+	assert.Empty(test, formatted)
+}
+
+func TestFormatterCachePlaceholders(test *testing.T) {
+	formatted, err := formatter.Format("{name} {p1}", formatter.Named{"name": "x"}, "y")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "x y", formatted)
+
+	formatted, err = formatter.Format("{name} {p1}", formatter.Named{"other": "x"}, "y")
+
+	assert.Error(test, err)
+	assert.Empty(test, formatted)
+
+	formatted, err = formatter.Format("{name} {p1}", formatter.Named{"name": "z"})
+
+	assert.Error(test, err)
+	assert.Empty(test, formatted)
+}
+
+func ExampleFormatter_Compile() {
+	message, err := formatter.New().Compile("Compiled {p}:{line}")
+
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(message.MustFormat("dir/file", formatter.Named{"line": 3}))
+	fmt.Println(message.MustFormat("dir/other", formatter.Named{"line": 7}))
+	// Output:
+	// Compiled dir/file:3
+	// Compiled dir/other:7
+}
+
+func TestFormatterCompile(test *testing.T) {
+	f := formatter.New().SetDelimiters("<", ">").SetPlaceholder("a").AddFunction("value", func() int { return 1 })
+
+	message, err := f.Compile("<a1> <a0> <value>")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "<a1> <a0> <value>", message.String())
+
+	f.Reset()
+
+	formatted, err := message.Format("x", "y", "z")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "y x 1 z", formatted)
+
+	buffer := new(bytes.Buffer)
+
+	assert.NoError(test, message.FormatWriter(buffer, 4, 5))
+	assert.Equal(test, "5 4 1", buffer.String())
+}
+
+func TestFormatterCompileError(test *testing.T) {
+	message, err := formatter.Compile("{p")
+
+	assert.Error(test, err)
+	assert.Nil(test, message)
+
+	assert.Panics(test, func() {
+		formatter.MustCompile("{end}")
+	})
+}
+
+func TestFormatterCompileFormatError(test *testing.T) {
+	message := formatter.MustCompile("{p1}")
+
+	formatted, err := message.Format(1)
+
+	assert.Error(test, err)
+	assert.Empty(test, formatted)
+
+	assert.Panics(test, func() {
+		message.MustFormat()
+	})
+
+	assert.Equal(test, "2 1", message.MustFormat(1, 2))
+}
+
+func TestFormatterCompileConcurrent(test *testing.T) {
+	message := formatter.MustCompile("{p}-{p}")
+	done := make(chan bool)
+
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			done <- message.MustFormat(i, i) == fmt.Sprintf("%d-%d", i, i)
+		}(i)
+	}
+
+	for i := 0; i < 8; i++ {
+		assert.True(test, <-done)
+	}
+}
+
+func ExampleFormat_formatSpecification() {
+	formatted, err := formatter.Format("[{p0:>8}] [{p0:08.3f}] [{name:^9}] [{p2:x}] [{p3:,}] [{p4:.2e}]", 3.14159, formatter.Named{
+		"name": "center",
+	}, 255, 1234567, 12345.678)
+
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(formatted)
+	// Output: [ 3.14159] [0003.142] [ center  ] [ff] [1,234,567] [1.23e+04]
+}
+
+func TestFormatterFormatSpecification(test *testing.T) {
+	object := struct {
+		Name  string
+		Value int
+	}{
+		Name:  "object",
+		Value: 42,
+	}
+
+	for _, entry := range []struct {
+		message   string
+		arguments []interface{}
+		expected  string
+	}{
+		{message: "{p:>5}", arguments: []interface{}{"ab"}, expected: "   ab"},
+		{message: "{p:<5}|", arguments: []interface{}{"ab"}, expected: "ab   |"},
+		{message: "{p:*^6}", arguments: []interface{}{"ab"}, expected: "**ab**"},
+		{message: "{p:5}|", arguments: []interface{}{"ab"}, expected: "ab   |"},
+		{message: "{p:5}", arguments: []interface{}{12}, expected: "   12"},
+		{message: "{p:.2}", arguments: []interface{}{"abcdef"}, expected: "ab"},
+		{message: "{p:+d}", arguments: []interface{}{5}, expected: "+5"},
+		{message: "{p: d}", arguments: []interface{}{5}, expected: " 5"},
+		{message: "{p:06d}", arguments: []interface{}{-42}, expected: "-00042"},
+		{message: "{p:=+6}", arguments: []interface{}{42}, expected: "+   42"},
+		{message: "{p:#x}", arguments: []interface{}{255}, expected: "0xff"},
+		{message: "{p:#X}", arguments: []interface{}{255}, expected: "0XFF"},
+		{message: "{p:#b}", arguments: []interface{}{5}, expected: "0b101"},
+		{message: "{p:o}", arguments: []interface{}{8}, expected: "10"},
+		{message: "{p:_b}", arguments: []interface{}{255}, expected: "1111_1111"},
+		{message: "{p:,}", arguments: []interface{}{-1234567}, expected: "-1,234,567"},
+		{message: "{p:c}", arguments: []interface{}{65}, expected: "A"},
+		{message: "{p:f}", arguments: []interface{}{1.5}, expected: "1.500000"},
+		{message: "{p:,.2f}", arguments: []interface{}{1234.5}, expected: "1,234.50"},
+		{message: "{p:E}", arguments: []interface{}{1234.5}, expected: "1.234500E+03"},
+		{message: "{p:.3g}", arguments: []interface{}{1234.5}, expected: "1.23e+03"},
+		{message: "{p:.1%}", arguments: []interface{}{0.25}, expected: "25.0%"},
+		{message: "{p:.2f}", arguments: []interface{}{7}, expected: "7.00"},
+		{message: "{p:,}", arguments: []interface{}{-1234567.5}, expected: "-1,234,567.5"},
+		{message: "{p:_}", arguments: []interface{}{123456789.25}, expected: "123_456_789.25"},
+		{message: "{p:,}", arguments: []interface{}{1e16}, expected: "1e+16"},
+		{message: "{p:,}", arguments: []interface{}{0.00001}, expected: "1e-05"},
+		{message: "{p:,}", arguments: []interface{}{0.0001}, expected: "0.0001"},
+		{message: "{p:>12,}", arguments: []interface{}{1234.5}, expected: "     1,234.5"},
+		{message: "{p:08,}", arguments: []interface{}{1234}, expected: "0,001,234"},
+		{message: "{p:+09,}", arguments: []interface{}{1234}, expected: "+0,001,234"},
+		{message: "{p:010,.1f}", arguments: []interface{}{-1234.5}, expected: "-001,234.5"},
+		{message: "{p:#011_x}", arguments: []interface{}{255}, expected: "0x0000_00ff"},
+		{message: "{p:07,}", arguments: []interface{}{1234}, expected: "001,234"},
+		{message: "{p:F}", arguments: []interface{}{math.Inf(1)}, expected: "INF"},
+		{message: "{p:>8}", arguments: []interface{}{time.Second}, expected: "      1s"},
+		{message: "{:>3}{:<3}|", arguments: []interface{}{1, 2}, expected: "  12  |"},
+		{message: "{.Name:>8} {.Value:04}", arguments: []interface{}{object}, expected: "  object 0042"},
+		{message: "{p.Name:.3}", arguments: []interface{}{object}, expected: "obj"},
+		{message: "{p | upper:>4}", arguments: []interface{}{"ab"}, expected: "  AB"},
+		{message: "{$x := p:>3}[{$x}]", arguments: []interface{}{1}, expected: "[  1]"},
+		{message: `{printf "%s:%s" p p:>5}`, arguments: []interface{}{"a", "b"}, expected: "  a:b"},
+		{message: "{/* a:b */}{p}", arguments: []interface{}{1}, expected: "1"},
+		{message: "a {- p:>3 -} b", arguments: []interface{}{1}, expected: "a  1b"},
+		{message: "{p | format \">3\"}", arguments: []interface{}{1}, expected: "  1"},
+	} {
+		formatted, err := formatter.Format(entry.message, entry.arguments...)
+
+		assert.NoError(test, err, entry.message)
+		assert.Equal(test, entry.expected, formatted, entry.message)
+	}
+}
+
+func TestFormatterFormatSpecificationDelimiters(test *testing.T) {
+	formatted, err := formatter.New().SetDelimiters("<<", ">>").Format("<<p:>4>> <<p1:.1f>>", 1, 2.25)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "   1 2.2", formatted)
+}
+
+func TestFormatterFormatSpecificationReserved(test *testing.T) {
+	formatted, err := formatter.Format("{id:>5} {format}", formatter.Named{"id": 1, "format": "json"})
+
+	assert.NoError(test, err)
+	assert.Equal(test, "    1 json", formatted)
+
+	formatted, err = formatter.Format("{id:>3}{range items}{.}{end}", formatter.Named{
+		"id":         1,
+		"items":      []int{2, 3},
+		"_format":    "x",
+		"_iteration": "y",
+	})
+
+	assert.NoError(test, err)
+	assert.Equal(test, "  123", formatted)
+
+	f := formatter.New().SetLimits(formatter.Limits{MaxRangeIterations: 1}).AddFunctions(formatter.Functions{
+		"format":     func() string { return "custom" },
+		"_format":    func() string { return "custom" },
+		"_iteration": func() string { return "custom" },
+	})
+
+	formatted, err = f.Format("{p:>3} {format}", 1)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "  1 custom", formatted)
+
+	_, err = f.Format("{range p}{end}", []int{1, 2})
+
+	assert.True(test, errors.Is(err, formatter.ErrRangeLimit))
+}
+
+func TestFormatterFormatSpecificationError(test *testing.T) {
+	for _, entry := range []struct {
+		message  string
+		argument interface{}
+	}{
+		{message: "{p:>5q}", argument: 1},
+		{message: "{p:.}", argument: 1},
+		{message: "{p:.2}", argument: 1},
+		{message: "{p:s}", argument: 1},
+		{message: "{p:d}", argument: 1.5},
+		{message: "{p:d}", argument: "text"},
+		{message: "{p:+}", argument: "text"},
+		{message: "{p:,}", argument: "text"},
+		{message: "{p:=5}", argument: "text"},
+		{message: "{p:c}", argument: -1},
+		{message: "{p:99999999999999999999}", argument: 1},
+	} {
+		formatted, err := formatter.Format(entry.message, entry.argument)
+
+		assert.Error(test, err, entry.message)
+		assert.Empty(test, formatted, entry.message)
+	}
+}
+
+func ExampleFormat_escapedDelimiters() {
+	formatted, err := formatter.Format(`{{"key": {p}}} {{p}}`, 5)
+
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(formatted)
+	// Output: {"key": 5} {p}
+}
+
+func TestFormatterEscapedDelimiters(test *testing.T) {
+	for _, entry := range []struct {
+		message  string
+		expected string
+	}{
+		{message: "{{", expected: "{ 1"},
+		{message: "}}", expected: "} 1"},
+		{message: "}", expected: "} 1"},
+		{message: "{{}}", expected: "{} 1"},
+		{message: "{{{p}}}", expected: "{1}"},
+		{message: "{{p}}", expected: "{p} 1"},
+		{message: "{{{{", expected: "{{ 1"},
+		{message: `{p | printf "%v}}"}`, expected: "1}}"},
+		{message: "{p:{>3}", expected: "{{1"},
+	} {
+		formatted, err := formatter.Format(entry.message, 1)
+
+		assert.NoError(test, err, entry.message)
+		assert.Equal(test, entry.expected, formatted, entry.message)
+	}
+}
+
+func TestFormatterEscapedDelimitersCustom(test *testing.T) {
+	f := formatter.New().SetDelimiters("<%", "%>")
+
+	formatted, err := f.Format("<%<%p%>%> <%<%<%p%>%>%>", 2)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "<%p%> <%2%>", formatted)
+}
+
+func TestFormatterFormatErrorParse(test *testing.T) {
+	_, err := formatter.Format("text\n{p")
+
+	var formatError *formatter.FormatError
+
+	assert.True(test, errors.As(err, &formatError))
+	assert.True(test, errors.Is(err, formatter.ErrParse))
+	assert.False(test, errors.Is(err, formatter.ErrExecute))
+	assert.Equal(test, formatter.ParseError, formatError.Kind)
+	assert.Equal(test, "text\n{p", formatError.Message)
+	assert.Equal(test, 2, formatError.Line)
+	assert.Equal(test, 0, formatError.Column)
+	assert.Equal(test, -1, formatError.Offset)
+	assert.NotNil(test, formatError.Unwrap())
+	assert.Equal(test, "formatter: parse error at 2: unclosed action", formatError.Error())
+}
+
+func TestFormatterFormatErrorUndefined(test *testing.T) {
+	_, err := formatter.Format("text\n  {{ {p:>3} {missing}", 1)
+
+	var formatError *formatter.FormatError
+
+	assert.True(test, errors.As(err, &formatError))
+	assert.True(test, errors.Is(err, formatter.ErrUndefined))
+	assert.True(test, errors.Is(err, formatter.ErrExecute))
+	assert.False(test, errors.Is(err, formatter.ErrFunction))
+	assert.Equal(test, "missing", formatError.Name)
+	assert.Equal(test, 18, formatError.Offset)
+	assert.Equal(test, 2, formatError.Line)
+	assert.Equal(test, 14, formatError.Column)
+	assert.Equal(test, `formatter: execute error at 2:14 in "missing": placeholder or function is not defined`, err.Error())
+}
+
+func TestFormatterFormatErrorFunction(test *testing.T) {
+	_, err := formatter.Format(`text {color "foo"}`)
+
+	var formatError *formatter.FormatError
+
+	assert.True(test, errors.As(err, &formatError))
+	assert.True(test, errors.Is(err, formatter.ErrFunction))
+	assert.False(test, errors.Is(err, formatter.ErrUndefined))
+	assert.Equal(test, formatter.FunctionError, formatError.Kind)
+	assert.Equal(test, "function", formatError.Kind.String())
+	assert.Equal(test, "color", formatError.Name)
+	assert.Equal(test, 6, formatError.Offset)
+	assert.Equal(test, 1, formatError.Line)
+	assert.Equal(test, 7, formatError.Column)
+	assert.Equal(test, "color is not supported", formatError.Unwrap().Error())
+}
+
+func TestFormatterFormatErrorSpecification(test *testing.T) {
+	_, err := formatter.Format("{p} {p:>5q}", 1, 2)
+
+	var formatError *formatter.FormatError
+
+	assert.True(test, errors.As(err, &formatError))
+	assert.True(test, errors.Is(err, formatter.ErrFunction))
+	assert.Equal(test, "format", formatError.Name)
+	assert.Equal(test, 6, formatError.Offset)
+	assert.Equal(test, 7, formatError.Column)
+}
+
+func TestFormatterFormatErrorExecute(test *testing.T) {
+	_, err := formatter.Format("{.Missing}", struct{ Value int }{})
+
+	var formatError *formatter.FormatError
+
+	assert.True(test, errors.As(err, &formatError))
+	assert.True(test, errors.Is(err, formatter.ErrExecute))
+	assert.Equal(test, formatter.ExecuteError, formatError.Kind)
+	assert.Equal(test, "execute", formatError.Kind.String())
+	assert.Equal(test, ".Missing", formatError.Name)
+	assert.Equal(test, 1, formatError.Offset)
+}
+
+func TestFormatterFormatErrorWriter(test *testing.T) {
+	for _, skip := range []int{0, 1} {
+		err := formatter.New().FormatWriter(&WriterError{Skip: skip}, "{p}", 2, 3)
+
+		var formatError *formatter.FormatError
+
+		assert.True(test, errors.As(err, &formatError))
+		assert.True(test, errors.Is(err, formatter.ErrWriter))
+		assert.Equal(test, "writer", formatError.Kind.String())
+		assert.Equal(test, Error("error"), errors.Unwrap(err))
+		assert.Equal(test, -1, formatError.Offset)
+		assert.Equal(test, "formatter: writer error: error", err.Error())
+	}
+}
+
+func TestFormatterStrict(test *testing.T) {
+	f := formatter.New()
+
+	assert.False(test, f.IsStrict())
+	assert.True(test, f.EnableStrict().IsStrict())
+
+	formatted, err := f.Format("{p} {p1} {name} {.Value}", 1, formatter.Named{"name": 2}, struct{ Value int }{3})
+
+	assert.NoError(test, err)
+	assert.Equal(test, "1 map[name:2] 2 3", formatted)
+
+	assert.False(test, f.DisableStrict().IsStrict())
+}
+
+func TestFormatterStrictUnused(test *testing.T) {
+	buffer := new(bytes.Buffer)
+
+	err := formatter.New().EnableStrict().FormatWriter(buffer, "{p}", 1, 2)
+
+	var formatError *formatter.FormatError
+
+	assert.True(test, errors.As(err, &formatError))
+	assert.True(test, errors.Is(err, formatter.ErrUnused))
+	assert.True(test, errors.Is(err, formatter.ErrExecute))
+	assert.Equal(test, "p1", formatError.Name)
+	assert.Empty(test, buffer.String())
+}
+
+func TestFormatterStrictMissing(test *testing.T) {
+	formatted, err := formatter.New().SetStrict(true).Format("{p} {p}", 1)
+
+	var formatError *formatter.FormatError
+
+	assert.Empty(test, formatted)
+	assert.True(test, errors.As(err, &formatError))
+	assert.True(test, errors.Is(err, formatter.ErrMissing))
+	assert.True(test, errors.Is(err, formatter.ErrExecute))
+	assert.Equal(test, "p", formatError.Name)
+	assert.Equal(test, 5, formatError.Offset)
+
+	formatted, err = formatter.New().Format("{p} {p}", 1)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "1 <no value>", formatted)
+}
+
+func TestFormatterStrictNamedMissing(test *testing.T) {
+	formatted, err := formatter.New().EnableStrict().Format("{name} {other}", formatter.Named{"name": 1})
+
+	assert.Empty(test, formatted)
+	assert.True(test, errors.Is(err, formatter.ErrUndefined))
+}
+
+func TestFormatterStrictWriterError(test *testing.T) {
+	err := formatter.New().EnableStrict().FormatWriter(new(WriterError), "{p}", 1)
+
+	assert.True(test, errors.Is(err, formatter.ErrWriter))
+}
+
+func ExampleFormatter_SetUnusedHandler() {
+	formatted, err := formatter.New().SetUnusedHandler(formatter.KeyValueUnused).Format("Login", formatter.Named{
+		"user": "bob",
+		"ip":   "10.0.0.1",
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println(formatted)
+
+	// Output: Login ip=10.0.0.1 user=bob
+}
+
+func TestFormatterUnusedAppend(test *testing.T) {
+	f := formatter.New()
+
+	assert.NotNil(test, f.GetUnusedHandler())
+
+	formatted, err := f.SetUnusedHandler(formatter.AppendUnused).Format("{p1}", 1, 2, 3)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "2 1 3", formatted)
+}
+
+func TestFormatterUnusedDrop(test *testing.T) {
+	formatted, err := formatter.New().SetUnusedHandler(formatter.DropUnused).Format("{p1}", 1, 2, 3)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "2", formatted)
+}
+
+func TestFormatterUnusedErrorHandler(test *testing.T) {
+	formatted, err := formatter.New().SetUnusedHandler(formatter.ErrorUnused).Format("{p1}", 1, 2, 3)
+
+	var formatError *formatter.FormatError
+
+	assert.Empty(test, formatted)
+	assert.True(test, errors.As(err, &formatError))
+	assert.True(test, errors.Is(err, formatter.ErrUnused))
+	assert.Equal(test, "p0", formatError.Name)
+}
+
+func TestFormatterUnusedKeyValue(test *testing.T) {
+	formatted, err := formatter.New().SetUnusedHandler(formatter.KeyValueUnused).Format("{p0}:",
+		1, "a b", formatter.Named{"key": `x="y"`}, "")
+
+	assert.NoError(test, err)
+	assert.Equal(test, `1: p1="a b" key="x=\"y\"" p3=""`, formatted)
+}
+
+func TestFormatterUnusedKeyValueStructuredKeys(test *testing.T) {
+	formatted, err := formatter.New().SetUnusedHandler(formatter.KeyValueUnused).Format("Login",
+		formatter.Named{"user.id": 7, "user id": 8, "_ok": 9})
+
+	assert.NoError(test, err)
+	assert.Equal(test, "Login _ok=9 user id=8 user.id=7", formatted)
+
+	formatted, err = formatter.Format("{name}", map[string]string{"name": "bob", "1st": "x", "a-b": "y"})
+
+	assert.NoError(test, err)
+	assert.Equal(test, "bob", formatted)
+}
+
+func TestFormatterUnusedCustom(test *testing.T) {
+	var positions []int
+
+	f := formatter.New().SetUnusedHandler(func(writer io.Writer, message string, unused []formatter.Unused) error {
+		for _, u := range unused {
+			positions = append(positions, u.Position)
+		}
+
+		_, err := io.WriteString(writer, " +"+strconv.Itoa(len(unused)))
+
+		return err
+	})
+
+	formatted, err := f.Format("{p1} {p3}", 0, 1, 2, 3, 4)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "1 3 +3", formatted)
+	assert.Equal(test, []int{0, 2, 4}, positions)
+}
+
+func TestFormatterUnusedCustomError(test *testing.T) {
+	_, err := formatter.New().SetUnusedHandler(func(io.Writer, string, []formatter.Unused) error {
+		return Error("error")
+	}).Format("{p}", 1, 2)
+
+	var formatError *formatter.FormatError
+
+	assert.True(test, errors.As(err, &formatError))
+	assert.True(test, errors.Is(err, formatter.ErrExecute))
+	assert.Equal(test, Error("error"), errors.Unwrap(err))
+}
+
+func TestFormatterUnusedStrict(test *testing.T) {
+	f := formatter.New().SetUnusedHandler(formatter.DropUnused).EnableStrict()
+
+	_, err := f.Format("{p}", 1, 2)
+
+	assert.True(test, errors.Is(err, formatter.ErrUnused))
+
+	formatted, err := f.DisableStrict().ResetUnusedHandler().Format("{p}", 1, 2)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "1 2", formatted)
+}
+
+func TestFormatterGetFunctionsCopy(test *testing.T) {
+	f := formatter.New().AddFunction("foo", func() string { return "foo" })
+
+	functions := f.GetFunctions()
+	functions["bar"] = func() string { return "bar" }
+
+	assert.Nil(test, f.GetFunction("bar"))
+	assert.Len(test, f.GetFunctions(), 1)
+}
+
+func TestFormatterSetFunctionsCopy(test *testing.T) {
+	functions := formatter.Functions{"foo": func() string { return "foo" }}
+
+	f := formatter.New().SetFunctions(functions)
+
+	functions["foo"] = func() string { return "bar" }
+
+	assert.Equal(test, "foo", f.MustFormat("{foo}"))
+}
+
+func TestFormatterClone(test *testing.T) {
+	parent := formatter.New().SetDelimiters("<", ">").AddFunction("foo", func() string { return "foo" })
+	child := parent.Clone().AddFunction("bar", func() string { return "bar" }).SetPlaceholder("x")
+
+	assert.Equal(test, "foo bar 1", child.MustFormat("<foo> <bar> <x>", 1))
+	assert.Nil(test, parent.GetFunction("bar"))
+	assert.Equal(test, formatter.DefaultPlaceholder, parent.GetPlaceholder())
+
+	_, err := parent.Format("<bar>")
+
+	assert.True(test, errors.Is(err, formatter.ErrUndefined))
+}
+
+func TestFormatterConcurrent(test *testing.T) {
+	var group sync.WaitGroup
+
+	f := formatter.New().AddFunction("foo", func() string { return "foo" })
+
+	for i := 0; i < 8; i++ {
+		group.Add(2)
+
+		go func() {
+			defer group.Done()
+
+			for j := 0; j < 100; j++ {
+				formatted, err := f.Format("{foo} {p}", j)
+
+				assert.NoError(test, err)
+				assert.Equal(test, "foo "+strconv.Itoa(j), formatted)
+			}
+		}()
+
+		go func(i int) {
+			defer group.Done()
+
+			name := "function" + strconv.Itoa(i)
+
+			for j := 0; j < 100; j++ {
+				f.AddFunction(name, func() int { return j })
+				f.SetEscapeSequences(j%2 == 0).SetStrict(false).SetUnusedHandler(nil)
+
+				assert.NotNil(test, f.GetFunctions()[name])
+
+				f.Clone().RemoveFunction(name).MustFormat("{p}", j)
+				f.RemoveFunction(name)
+			}
+		}(i)
+	}
+
+	group.Wait()
+
+	assert.Len(test, f.GetFunctions(), 1)
+}
+
+func TestFormatterDefault(test *testing.T) {
+	defer formatter.SetDefault(nil)
+
+	assert.NotNil(test, formatter.Default())
+
+	formatter.SetDefault(formatter.New().SetDelimiters("<", ">").AddFunction("team", func() string {
+		return "core"
+	}))
+
+	assert.Equal(test, "core 1", formatter.MustFormat("<team> <p>", 1))
+	assert.Equal(test, "core", formatter.MustCompile("<team>").MustFormat())
+
+	buffer := new(bytes.Buffer)
+
+	assert.NoError(test, formatter.FormatWriter(buffer, "<team>"))
+	assert.Equal(test, "core", buffer.String())
+
+	formatter.Default().AddFunction("team", func() string { return "tools" })
+
+	formatted, err := formatter.Format("<team>")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "tools", formatted)
+
+	formatter.SetDefault(nil)
+
+	assert.Equal(test, formatter.DefaultLeftDelimiter, formatter.Default().GetLeftDelimiter())
+}
+
+func TestFormatterDefaultConcurrent(test *testing.T) {
+	var group sync.WaitGroup
+
+	defer formatter.SetDefault(nil)
+
+	for i := 0; i < 8; i++ {
+		group.Add(2)
+
+		go func() {
+			defer group.Done()
+
+			for j := 0; j < 100; j++ {
+				assert.Equal(test, strconv.Itoa(j), formatter.MustFormat("{p}", j))
+			}
+		}()
+
+		go func() {
+			defer group.Done()
+
+			for j := 0; j < 100; j++ {
+				formatter.SetDefault(formatter.New())
+			}
+		}()
+	}
+
+	group.Wait()
+}
+
+func TestFormatterAreEscapeSequencesSupportedBy(test *testing.T) {
+	defer func(value string) {
+		assert.NoError(test, os.Setenv(formatter.ForceEscapeSequencesEnv, value))
+	}(os.Getenv(formatter.ForceEscapeSequencesEnv))
+
+	file, err := ioutil.TempFile("", "formatter")
+
+	assert.NoError(test, err)
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	assert.NoError(test, os.Setenv(formatter.ForceEscapeSequencesEnv, "true"))
+	assert.True(test, formatter.AreEscapeSequencesSupportedBy(file))
+	assert.False(test, formatter.AreEscapeSequencesSupportedBy(new(bytes.Buffer)))
+
+	assert.NoError(test, os.Setenv(formatter.ForceEscapeSequencesEnv, ""))
+	assert.False(test, formatter.AreEscapeSequencesSupportedBy(file))
+
+	formatter.ClearTerminalCache()
+
+	assert.False(test, formatter.AreEscapeSequencesSupportedBy(file))
+}
+
+func TestFormatterEscapeSequencesMode(test *testing.T) {
+	f := formatter.New()
+
+	assert.Equal(test, f.AreEscapeSequencesEnabled(), f.GetEscapeSequencesMode() == formatter.EscapeSequencesAlways)
+
+	assert.Equal(test, formatter.EscapeSequencesNever, f.DisableEscapeSequences().GetEscapeSequencesMode())
+	assert.Equal(test, formatter.EscapeSequencesAlways, f.EnableEscapeSequences().GetEscapeSequencesMode())
+	assert.Equal(test, formatter.EscapeSequencesAuto, f.SetEscapeSequencesMode(formatter.EscapeSequencesAuto).GetEscapeSequencesMode())
+	assert.Equal(test, formatter.New().GetEscapeSequencesMode(), f.ResetEscapeSequencesMode().GetEscapeSequencesMode())
+
+	assert.Equal(test, "auto", formatter.EscapeSequencesAuto.String())
+	assert.Equal(test, "always", formatter.EscapeSequencesAlways.String())
+	assert.Equal(test, "never", formatter.EscapeSequencesNever.String())
+	assert.Equal(test, "unknown", formatter.EscapeSequencesMode(-1).String())
+}
+
+func TestFormatterEscapeSequencesAuto(test *testing.T) {
+	defer func(value string) {
+		assert.NoError(test, os.Setenv(formatter.ForceEscapeSequencesEnv, value))
+	}(os.Getenv(formatter.ForceEscapeSequencesEnv))
+
+	file, err := ioutil.TempFile("", "formatter")
+
+	assert.NoError(test, err)
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	f := formatter.New().SetEscapeSequencesMode(formatter.EscapeSequencesAuto)
+	m := f.MustCompile("{red}text")
+
+	assert.NoError(test, os.Setenv(formatter.ForceEscapeSequencesEnv, "false"))
+	assert.NoError(test, f.FormatWriter(file, "{red}text"))
+	assert.NoError(test, m.FormatWriter(file, nil))
+
+	assert.NoError(test, os.Setenv(formatter.ForceEscapeSequencesEnv, "true"))
+	assert.NoError(test, f.FormatWriter(file, "{red}text"))
+	assert.NoError(test, m.FormatWriter(file))
+
+	content, err := ioutil.ReadFile(file.Name())
+
+	assert.NoError(test, err)
+	assert.Equal(test, "texttext <nil>\033[31mtext\033[31mtext", string(content))
+
+	formatted, err := f.Format("{red}text")
+
+	assert.NoError(test, err)
+	assert.Equal(test, m.MustFormat(), formatted)
+}
+
+func TestFormatterDetectEscapeSequences(test *testing.T) {
+	names := []string{
+		formatter.ForceEscapeSequencesEnv,
+		formatter.NoColorEnv,
+		formatter.CliColorForceEnv,
+		formatter.CliColorEnv,
+		formatter.TermEnv,
+		formatter.ColorTermEnv,
+	}
+
+	for _, name := range names {
+		value, ok := os.LookupEnv(name)
+
+		defer func(name, value string, ok bool) {
+			if ok {
+				assert.NoError(test, os.Setenv(name, value))
+			} else {
+				assert.NoError(test, os.Unsetenv(name))
+			}
+		}(name, value, ok)
+	}
+
+	file, err := ioutil.TempFile("", "formatter")
+
+	assert.NoError(test, err)
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	for _, tt := range []struct {
+		env      map[string]string
+		decision string
+	}{
+		{map[string]string{}, "disabled: not a terminal"},
+		{map[string]string{"FORCE_ESCAPE_SEQUENCES": "on", "NO_COLOR": "1"}, "enabled: FORCE_ESCAPE_SEQUENCES=on"},
+		{map[string]string{"FORCE_ESCAPE_SEQUENCES": "off", "CLICOLOR_FORCE": "1"}, "disabled: FORCE_ESCAPE_SEQUENCES=off"},
+		{map[string]string{"FORCE_ESCAPE_SEQUENCES": "auto", "NO_COLOR": "1"}, "disabled: NO_COLOR is set"},
+		{map[string]string{"NO_COLOR": "1", "CLICOLOR_FORCE": "1"}, "disabled: NO_COLOR is set"},
+		{map[string]string{"NO_COLOR": "", "CLICOLOR_FORCE": "1"}, "enabled: CLICOLOR_FORCE=1"},
+		{map[string]string{"CLICOLOR_FORCE": "1", "CLICOLOR": "0"}, "enabled: CLICOLOR_FORCE=1"},
+		{map[string]string{"CLICOLOR_FORCE": "0", "CLICOLOR": "0"}, "disabled: CLICOLOR=0"},
+		{map[string]string{"CLICOLOR": "1", "TERM": "dumb"}, "disabled: TERM=dumb"},
+		{map[string]string{"TERM": "dumb", "COLORTERM": "truecolor"}, "disabled: not a terminal"},
+	} {
+		for _, name := range names {
+			assert.NoError(test, os.Unsetenv(name))
+		}
+
+		for name, value := range tt.env {
+			assert.NoError(test, os.Setenv(name, value))
+		}
+
+		assert.Equal(test, tt.decision, formatter.DetectEscapeSequencesBy(file).String(), tt.env)
+	}
+
+	assert.Equal(test, "disabled: writer does not provide file descriptor", formatter.DetectEscapeSequencesBy(nil).String())
+}
+
+func TestFormatterGetEscapeSequencesDecision(test *testing.T) {
+	f := formatter.New()
+
+	assert.Equal(test, "enabled: mode is always", f.EnableEscapeSequences().GetEscapeSequencesDecision(nil).String())
+	assert.Equal(test, "disabled: mode is never", f.DisableEscapeSequences().GetEscapeSequencesDecision(os.Stdout).String())
+
+	f.SetEscapeSequencesMode(formatter.EscapeSequencesAuto)
+
+	assert.Equal(test, formatter.DetectEscapeSequencesBy(os.Stderr), f.GetEscapeSequencesDecision(os.Stderr))
+}
+
+func TestFormatterColorProfile(test *testing.T) {
+	f := formatter.New().EnableEscapeSequences()
+
+	assert.Equal(test, formatter.DetectColorProfile(), f.GetColorProfile())
+
+	for _, tt := range []struct {
+		profile formatter.ColorProfile
+		message string
+		expect  string
+	}{
+		{formatter.ColorProfileTrueColor, "{rgb 255 165 0}", "\x1b[38;2;255;165;0m"},
+		{formatter.ColorProfileANSI256, "{rgb 255 165 0}", "\x1b[38;5;214m"},
+		{formatter.ColorProfileANSI256, `{color "0x808080"}`, "\x1b[38;5;244m"},
+		{formatter.ColorProfileANSI256, "{rgb 0 0 0 | background}", "\x1b[48;5;16m"},
+		{formatter.ColorProfileANSI, "{rgb 255 165 0}", "\x1b[33m"},
+		{formatter.ColorProfileANSI, `{color "0xFFFFFF" | background}`, "\x1b[107m"},
+		{formatter.ColorProfileANSI, "{rgb 200 0 0 | background | foreground}", "\x1b[31m"},
+		{formatter.ColorProfileNone, "{bold}{rgb 255 165 0 | background}{red | bright}{color `0xFF0000`}", "\x1b[1m"},
+	} {
+		formatted, err := f.SetColorProfile(tt.profile).Format(tt.message)
+
+		assert.NoError(test, err)
+		assert.Equal(test, tt.expect, formatted, tt.profile.String())
+	}
+
+	assert.Equal(test, formatter.DetectColorProfile(), f.ResetColorProfile().GetColorProfile())
+	assert.Equal(test, "auto", formatter.ColorProfileAuto.String())
+	assert.Equal(test, "unknown", formatter.ColorProfile(-1).String())
+}
+
+func TestFormatterDetectColorProfile(test *testing.T) {
+	for _, name := range []string{formatter.TermEnv, formatter.ColorTermEnv, formatter.ForceEscapeSequencesEnv,
+		formatter.NoColorEnv, formatter.CliColorForceEnv} {
+		value, ok := os.LookupEnv(name)
+
+		defer func(name, value string, ok bool) {
+			if ok {
+				assert.NoError(test, os.Setenv(name, value))
+			} else {
+				assert.NoError(test, os.Unsetenv(name))
+			}
+		}(name, value, ok)
+
+		assert.NoError(test, os.Unsetenv(name))
+	}
+
+	for _, tt := range []struct {
+		term      string
+		colorTerm string
+		profile   formatter.ColorProfile
+	}{
+		{"xterm", "truecolor", formatter.ColorProfileTrueColor},
+		{"xterm", "24bit", formatter.ColorProfileTrueColor},
+		{"xterm-direct", "", formatter.ColorProfileTrueColor},
+		{"xterm-256color", "", formatter.ColorProfileANSI256},
+		{"xterm", "", formatter.ColorProfileANSI},
+		{"dumb", "", formatter.ColorProfileNone},
+		{"", "", formatter.ColorProfileTrueColor},
+	} {
+		assert.NoError(test, os.Setenv(formatter.TermEnv, tt.term))
+		assert.NoError(test, os.Setenv(formatter.ColorTermEnv, tt.colorTerm))
+		assert.Equal(test, tt.profile, formatter.DetectColorProfile(), tt.term)
+	}
+
+	assert.NoError(test, os.Setenv(formatter.TermEnv, "dumb"))
+	assert.NoError(test, os.Setenv(formatter.ColorTermEnv, ""))
+
+	for _, tt := range []struct {
+		force         string
+		cliColorForce string
+		profile       formatter.ColorProfile
+	}{
+		{"enable", "", formatter.ColorProfileANSI},
+		{"", "1", formatter.ColorProfileANSI},
+		{"disable", "1", formatter.ColorProfileNone},
+		{"", "0", formatter.ColorProfileNone},
+	} {
+		assert.NoError(test, os.Setenv(formatter.ForceEscapeSequencesEnv, tt.force))
+		assert.NoError(test, os.Setenv(formatter.CliColorForceEnv, tt.cliColorForce))
+		assert.NoError(test, os.Unsetenv(formatter.NoColorEnv))
+		assert.Equal(test, tt.profile, formatter.DetectColorProfile(), tt.force+tt.cliColorForce)
+	}
+}
+
+func TestFormatterANSI256(test *testing.T) {
+	f := formatter.New().EnableEscapeSequences().SetColorProfile(formatter.ColorProfileANSI256)
+
+	for message, expect := range map[string]string{
+		"{ansi256 208}":                         "\x1b[38;5;208m",
+		`{color "ansi256(208)"}`:                "\x1b[38;5;208m",
+		`{color "ANSI256( 33 )" | background}`:  "\x1b[48;5;33m",
+		"{ansi256 1 | bright}":                  "\x1b[38;5;9m",
+		"{ansi256 2 | background | bright}":     "\x1b[48;5;10m",
+		"{ansi256 200 | bright}":                "\x1b[38;5;200m",
+		"{ansi256 3 | background | foreground}": "\x1b[38;5;3m",
+	} {
+		formatted, err := f.Format(message)
+
+		assert.NoError(test, err)
+		assert.Equal(test, expect, formatted, message)
+	}
+
+	for message, expect := range map[string]string{
+		"{ansi256 9}":                "\x1b[91m",
+		"{ansi256 208}":              "\x1b[33m",
+		"{ansi256 244 | background}": "\x1b[100m",
+		"{ansi256 1 | bright}":       "\x1b[91m",
+	} {
+		formatted, err := f.SetColorProfile(formatter.ColorProfileANSI).Format(message)
+
+		assert.NoError(test, err)
+		assert.Equal(test, expect, formatted, message)
+	}
+
+	formatted, err := f.SetColorProfile(formatter.ColorProfileTrueColor).Format("{ansi256 208}")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "\x1b[38;5;208m", formatted)
+
+	formatted, err = f.DisableEscapeSequences().Format("{ansi256 208}text")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "text", formatted)
+}
+
+func TestFormatterANSI256Error(test *testing.T) {
+	for _, message := range []string{"{ansi256 256}", "{ansi256 -1}", `{color "ansi256(x)"}`, `{color "ansi256(300)"}`} {
+		_, err := formatter.New().EnableEscapeSequences().Format(message)
+
+		assert.True(test, errors.Is(err, formatter.ErrFunction), message)
+	}
+}
+
+func TestFormatterColorCSS(test *testing.T) {
+	f := formatter.New().EnableEscapeSequences().SetColorProfile(formatter.ColorProfileTrueColor)
+
+	for message, expect := range map[string]string{
+		`{color "tomato"}`:                        "\x1b[38;2;255;99;71m",
+		`{color "SteelBlue" | background}`:        "\x1b[48;2;70;130;180m",
+		`{color "red"}`:                           "\x1b[31m",
+		`{color "#F60"}`:                          "\x1b[38;2;255;102;0m",
+		`{color "#1e90ff"}`:                       "\x1b[38;2;30;144;255m",
+		`{color "rgb(255, 165, 0)"}`:              "\x1b[38;2;255;165;0m",
+		`{color "rgb(100% 50% 0%)"}`:              "\x1b[38;2;255;128;0m",
+		`{color "hsl(120, 100%, 25%)"}`:           "\x1b[38;2;0;128;0m",
+		`{color "hsl(-120deg 100% 50%)"}`:         "\x1b[38;2;0;0;255m",
+		`{color "hsl(9, 100%, 64%)"}`:             "\x1b[38;2;255;99;71m",
+		`{color "rgb(0,0,0)" | background}`:       "\x1b[48;2;0;0;0m",
+		`{color "hsl(0, 0%, 100%)" | foreground}`: "\x1b[38;2;255;255;255m",
+	} {
+		formatted, err := f.Format(message)
+
+		assert.NoError(test, err)
+		assert.Equal(test, expect, formatted, message)
+	}
+
+	formatted, err := f.SetColorProfile(formatter.ColorProfileANSI256).Format(`{color "tomato"}`)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "\x1b[38;5;203m", formatted)
+}
+
+func TestFormatterColorCSSError(test *testing.T) {
+	for _, color := range []string{"#12", "#12345g", "rgb(1, 2)", "rgb(256, 0, 0)", "rgb(a, b, c)", "hsl(0, 200%, 50%)", "unknown"} {
+		_, err := formatter.New().EnableEscapeSequences().Format(`{color "` + color + `"}`)
+
+		assert.True(test, errors.Is(err, formatter.ErrFunction), color)
+	}
+}
+
+func ExampleFormatter_AddStyle() {
+	f := formatter.New().EnableEscapeSequences().AddStyle("error", "bold red")
+
+	fmt.Printf("%q\n", f.MustFormat(`{error}Error:{end} {style "error"}{p}{end}`, "failed"))
+
+	// Output: "\x1b[1m\x1b[31mError:\x1b[0m \x1b[1m\x1b[31mfailed\x1b[0m"
+}
+
+func TestFormatterStyle(test *testing.T) {
+	f := formatter.New().EnableEscapeSequences().SetColorProfile(formatter.ColorProfileTrueColor).AddStyles(formatter.Styles{
+		"error":   "bold red",
+		"path":    "underline cyan",
+		"warning": "black on yellow bright",
+		"tomato":  "italic tomato on #000",
+	})
+
+	for _, tt := range []struct {
+		message   string
+		arguments []interface{}
+		expect    string
+	}{
+		{"{error}text{end}", nil, "\x1b[1m\x1b[31mtext\x1b[0m"},
+		{`{style "path"}text{end}`, nil, "\x1b[4m\x1b[36mtext\x1b[0m"},
+		{"{warning}text{end}", nil, "\x1b[30m\x1b[103mtext\x1b[0m"},
+		{"{tomato}text{endStyle}", nil, "\x1b[3m\x1b[38;2;255;99;71m\x1b[48;2;0;0;0mtext\x1b[0m"},
+		{"{if p0}{error}{p0}{endStyle}{end}", []interface{}{1}, "\x1b[1m\x1b[31m1\x1b[0m"},
+		{"{range $i := p0}{path}{$i}{endStyle}{end}", []interface{}{[]int{2}}, "\x1b[4m\x1b[36m2\x1b[0m"},
+		{"{if p0}{error}{end}text{reset}", []interface{}{true}, "\x1b[1m\x1b[31mtext\x1b[0m"},
+		{"{error}{if p0}yes{end}{end}", []interface{}{true}, "\x1b[1m\x1b[31myes\x1b[0m"},
+		{"{endStyle}", nil, "\x1b[0m"},
+		{"text {- endStyle -} ", nil, "text\x1b[0m"},
+	} {
+		formatted, err := f.Format(tt.message, tt.arguments...)
+
+		assert.NoError(test, err)
+		assert.Equal(test, tt.expect, formatted, tt.message)
+	}
+
+	for _, message := range []string{"{end}", "text {- end -} ", "{error}text{end}{end}"} {
+		_, err := f.Format(message)
+
+		assert.True(test, errors.Is(err, formatter.ErrParse), message)
+	}
+
+	formatted, err := f.DisableEscapeSequences().Format("{error}text{end}")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "text", formatted)
+
+	formatted, err = f.SetColorProfile(formatter.ColorProfileNone).EnableEscapeSequences().Format("{error}text{end}")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "\x1b[1mtext\x1b[0m", formatted)
+
+	assert.Equal(test, "bold red", f.GetStyle("error"))
+	assert.Empty(test, f.ResetTheme().GetStyle("error"))
+}
+
+func TestFormatterStyleError(test *testing.T) {
+	f := formatter.New().EnableEscapeSequences().AddStyles(formatter.Styles{
+		"unknown":    "bold unknown",
+		"bright":     "bright red",
+		"background": "red on",
+	})
+
+	for _, message := range []string{`{style "missing"}`, "{unknown}", "{bright}", "{background}"} {
+		_, err := f.Format(message)
+
+		assert.True(test, errors.Is(err, formatter.ErrFunction), message)
+	}
+}
+
+func TestFormatterStyleScope(test *testing.T) {
+	f := formatter.New().EnableEscapeSequences().SetColorProfile(formatter.ColorProfileTrueColor).AddStyle("error", "bold red").
+		SetUnusedHandler(formatter.DropUnused)
+
+	for _, tt := range []struct {
+		message string
+		expect  string
+	}{
+		{"{red}a{bold}b{end}c{end}d", "\x1b[31ma\x1b[1mb\x1b[0m\x1b[31mc\x1b[0md"},
+		{"{red}a{green \"b\"}c{end}", "\x1b[31ma\x1b[32mb\x1b[0m\x1b[31mc\x1b[0m"},
+		{"{red}a{p0 | green}c{end}", "\x1b[31ma\x1b[32mb\x1b[0m\x1b[31mc\x1b[0m"},
+		{"{red}a{error}b{end}c{end}", "\x1b[31ma\x1b[1m\x1b[31mb\x1b[0m\x1b[31mc\x1b[0m"},
+		{"{red | bright}a{bold}b{end}c{end}", "\x1b[91ma\x1b[1mb\x1b[0m\x1b[91mc\x1b[0m"},
+		{"{rgb 1 2 3}a{ansi256 4}b{end}c{end}", "\x1b[38;2;1;2;3ma\x1b[38;5;4mb\x1b[0m\x1b[38;2;1;2;3mc\x1b[0m"},
+		{"{red}a{if true}b{end}c{end}", "\x1b[31mabc\x1b[0m"},
+		{"{red}a{bold}b{reset}c", "\x1b[31ma\x1b[1mb\x1b[0mc"},
+		{"{red}a{bold (green \"b\")}c{end}", "\x1b[31ma\x1b[1m\x1b[32mb\x1b[0m\x1b[31m\x1b[1m\x1b[31m\x1b[0m\x1b[31mc\x1b[0m"},
+	} {
+		formatted, err := f.Format(tt.message, "b")
+
+		assert.NoError(test, err)
+		assert.Equal(test, tt.expect, formatted, tt.message)
+	}
+
+	for _, tt := range []struct {
+		message   string
+		arguments []interface{}
+		expect    string
+	}{
+		{"{if p}{red}{end}text{reset}", []interface{}{true}, "\x1b[31mtext\x1b[0m"},
+		{"{range p}{bold}{.}{end}", []interface{}{[]int{1, 2}}, "\x1b[1m1\x1b[1m2"},
+		{"{range p}{bold}{.}{endStyle}{end}", []interface{}{[]int{1, 2}}, "\x1b[1m1\x1b[0m\x1b[1m2\x1b[0m"},
+		{"{red}a{endStyle}{if p}b{end}", []interface{}{true}, "\x1b[31ma\x1b[0mb"},
+		{"{red}", []interface{}{formatter.Named{"red": 5}}, "5"},
+		{"{color}", []interface{}{formatter.Named{"color": "blue"}}, "blue"},
+	} {
+		formatted, err := f.Format(tt.message, tt.arguments...)
+
+		assert.NoError(test, err)
+		assert.Equal(test, tt.expect, formatted, tt.message)
+	}
+
+	formatted, err := f.DisableEscapeSequences().Format("{red}a{bold}b{end}{green p0}{end}", "c")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "abc", formatted)
+}
+
+func TestFormatterLink(test *testing.T) {
+	f := formatter.New().EnableEscapeSequences().SetUnusedHandler(formatter.DropUnused)
+
+	for _, tt := range []struct {
+		message string
+		expect  string
+	}{
+		{`{link "https://go.dev"}`, "\x1b]8;;https://go.dev\x1b\\https://go.dev\x1b]8;;\x1b\\"},
+		{`{link "https://go.dev" "Go"}`, "\x1b]8;;https://go.dev\x1b\\Go\x1b]8;;\x1b\\"},
+		{`{p | link "https://go.dev"}`, "\x1b]8;;https://go.dev\x1b\\text\x1b]8;;\x1b\\"},
+		{"{link \"https://go.dev\\x1b\\a\" \"Go\"}", "\x1b]8;;https://go.dev\x1b\\Go\x1b]8;;\x1b\\"},
+	} {
+		formatted, err := f.Format(tt.message, "text")
+
+		assert.NoError(test, err)
+		assert.Equal(test, tt.expect, formatted, tt.message)
+	}
+
+	f.DisableEscapeSequences()
+
+	for _, tt := range []struct {
+		message string
+		expect  string
+	}{
+		{`{link "https://go.dev"}`, "https://go.dev"},
+		{`{link "https://go.dev" "Go"}`, "Go (https://go.dev)"},
+		{`{p | link "https://go.dev"}`, "text (https://go.dev)"},
+		{`{link "https://go.dev" "https://go.dev"}`, "https://go.dev"},
+	} {
+		formatted, err := f.Format(tt.message, "text")
+
+		assert.NoError(test, err)
+		assert.Equal(test, tt.expect, formatted, tt.message)
+	}
+}
+
+func TestFormatterStripEscapeSequences(test *testing.T) {
+	for _, tt := range []struct {
+		text   string
+		expect string
+	}{
+		{"text", "text"},
+		{"\x1b[1;31mbold red\x1b[0m", "bold red"},
+		{"\x1b[38;2;255;165;0mfunky\x1b[0m text", "funky text"},
+		{"\x1b]8;;https://go.dev\x1b\\Go\x1b]8;;\x1b\\", "Go"},
+		{"\x1b]0;title\abody", "body"},
+		{"\x1b(Bcharset", "charset"},
+		{"unterminated\x1b[31", "unterminated"},
+		{"escape\x1b", "escape"},
+	} {
+		assert.Equal(test, tt.expect, formatter.StripEscapeSequences(tt.text), tt.text)
+	}
+}
+
+func TestFormatterVisibleWidth(test *testing.T) {
+	for _, tt := range []struct {
+		text   string
+		expect int
+	}{
+		{"", 0},
+		{"text", 4},
+		{"\x1b[31mred\x1b[0m", 3},
+		{"日本語", 6},
+		{"ｆｕｌｌ", 8},
+		{"한국어", 6},
+		{"e\u0301", 1},
+		{"🙂", 2},
+		{"👍🏽", 2},
+		{"👨\u200d👩\u200d👧", 2},
+		{"🇵🇱", 2},
+		{"❤\ufe0f", 2},
+		{"a\tb", 2},
+	} {
+		assert.Equal(test, tt.expect, formatter.VisibleWidth(tt.text), tt.text)
+	}
+}
+
+func TestFormatterFormatDual(test *testing.T) {
+	f := formatter.New().DisableEscapeSequences()
+
+	colored, plain, err := f.FormatDual("{red}Error:{end} {p | bold}", "failed")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "\x1b[31mError:\x1b[0m \x1b[1mfailed\x1b[0m", colored)
+	assert.Equal(test, "Error: failed", plain)
+
+	m := f.MustCompile("{green p}")
+
+	colored, plain, err = m.FormatDual("ok")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "\x1b[32mok\x1b[0m", colored)
+	assert.Equal(test, "ok", plain)
+
+	_, _, err = f.FormatDual("{missing}")
+
+	assert.True(test, errors.Is(err, formatter.ErrUndefined))
+}
+
+func TestFormatterParseSpans(test *testing.T) {
+	spans := formatter.ParseSpans("plain \x1b[1;31mbold red\x1b[22m red\x1b[0m \x1b[38;5;196;48;2;0;0;255mx\x1b[0m" +
+		"\x1b]8;;https://go.dev\x1b\\\x1b[4mGo\x1b[24m\x1b]8;;\x1b\\")
+
+	assert.Equal(test, []formatter.Span{
+		{Text: "plain "},
+		{Text: "bold red", Style: formatter.SpanStyle{Bold: true, Foreground: "#cd0000"}},
+		{Text: " red", Style: formatter.SpanStyle{Foreground: "#cd0000"}},
+		{Text: " "},
+		{Text: "x", Style: formatter.SpanStyle{Foreground: "#ff0000", Background: "#0000ff"}},
+		{Text: "Go", Style: formatter.SpanStyle{Underline: true, Link: "https://go.dev"}},
+	}, spans)
+
+	assert.Empty(test, formatter.ParseSpans("\x1b[31m\x1b[0m"))
+}
+
+func TestFormatterBackend(test *testing.T) {
+	f := formatter.New().DisableEscapeSequences()
+	message := `{red}<error>{end} {bold}{italic}a_b{end}{end} {link "https://go.dev" "Go"}`
+
+	assert.Nil(test, f.GetBackend())
+
+	for _, tt := range []struct {
+		backend formatter.Backend
+		expect  string
+	}{
+		{nil, "<error> a_b Go (https://go.dev)"},
+		{formatter.HTMLBackend, `<span style="color:#cd0000">&lt;error&gt;</span> ` +
+			`<span style="font-weight:bold;font-style:italic">a_b</span> <a href="https://go.dev">Go</a>`},
+		{formatter.MarkdownBackend, "&lt;error&gt; **_a\\_b_** [Go](https://go.dev)"},
+		{formatter.SpansBackend, `[{"text":"\u003cerror\u003e","style":{"foreground":"#cd0000"}},{"text":" ","style":{}},` +
+			`{"text":"a_b","style":{"bold":true,"italic":true}},{"text":" ","style":{}},` +
+			`{"text":"Go","style":{"link":"https://go.dev"}}]`},
+	} {
+		formatted, err := f.SetBackend(tt.backend).Format(message)
+
+		assert.NoError(test, err)
+		assert.Equal(test, tt.expect, formatted)
+	}
+
+	formatted, err := f.SetBackend(formatter.HTMLBackend).Format(`{link "javascript:alert(1)" "x"}{p}`, "<b>")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "x&lt;b&gt;", formatted)
+
+	formatted, err = f.SetBackend(formatter.MarkdownBackend).Format(`{link "javascript:alert(1)" "click"} ` +
+		`{link "https://go.dev/a b(c)" "Go"}`)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "click [Go](https://go.dev/a%20b%28c%29)", formatted)
+
+	formatted, err = f.SetBackend(formatter.HTMLBackend).Format("{p} {red p1}{.Name} {link p3 p3}",
+		"\x1b]8;;https://evil\x1b\\phish", "\x1b[1mbold", struct{ Name string }{"\x1b[0m"}, "https://go.dev/\x1b\\x")
+
+	assert.NoError(test, err)
+	assert.Equal(test, `]8;;https://evil\phish <span style="color:#cd0000">[1mbold</span>[0m `+
+		`<a href="https://go.dev/\x">https://go.dev/\x</a>`, formatted)
+
+	formatted, err = f.SetBackend(formatter.MarkdownBackend).Format("{bold}{p}{end} a&b", "<img src=x onerror=alert(1)>")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "**&lt;img src=x onerror=alert(1)&gt;** a&amp;b", formatted)
+
+	formatted, err = f.SetBackend(formatter.HTMLBackend).Format(`{rgb 255 99 71}x{end}`)
+
+	assert.NoError(test, err)
+	assert.Equal(test, `<span style="color:#ff6347">x</span>`, formatted)
+
+	_, err = f.SetBackend(func(string) (string, error) {
+		return "", errors.New("failed")
+	}).Format("text")
+
+	assert.True(test, errors.Is(err, formatter.ErrWriter))
+	assert.Nil(test, f.ResetBackend().GetBackend())
+}
+
+func TestFormatterBackendDumbTerminal(test *testing.T) {
+	for _, name := range []string{formatter.TermEnv, formatter.ColorTermEnv, formatter.ForceEscapeSequencesEnv, formatter.CliColorForceEnv} {
+		value, ok := os.LookupEnv(name)
+
+		defer func(name, value string, ok bool) {
+			if ok {
+				assert.NoError(test, os.Setenv(name, value))
+			} else {
+				assert.NoError(test, os.Unsetenv(name))
+			}
+		}(name, value, ok)
+
+		assert.NoError(test, os.Unsetenv(name))
+	}
+
+	assert.NoError(test, os.Setenv(formatter.TermEnv, "dumb"))
+	assert.Equal(test, formatter.ColorProfileNone, formatter.DetectColorProfile())
+
+	message := `{rgb 255 99 71}x{end}`
+	expect := `<span style="color:#ff6347">x</span>`
+
+	for _, f := range []*formatter.Formatter{
+		formatter.New().SetColorProfile(formatter.DetectColorProfile()),
+		formatter.New().SetColorProfile(formatter.ColorProfileANSI),
+		formatter.New().SetStyleRenderer(bracketRenderer{}),
+	} {
+		formatted, err := f.SetBackend(formatter.HTMLBackend).Format(message)
+
+		assert.NoError(test, err)
+		assert.Equal(test, expect, formatted)
+
+		m, err := f.Compile(message)
+
+		assert.NoError(test, err)
+
+		formatted, err = m.Format()
+
+		assert.NoError(test, err)
+		assert.Equal(test, expect, formatted)
+	}
+}
+
+type bracketRenderer struct{}
+
+func (bracketRenderer) Reset() string {
+	return "[/]"
+}
+
+func (bracketRenderer) Attribute(attribute formatter.Attribute) string {
+	return "[" + attribute.String() + "]"
+}
+
+func (bracketRenderer) AttributeOff(attribute formatter.Attribute) string {
+	return "[/" + attribute.String() + "]"
+}
+
+func (bracketRenderer) Foreground(color formatter.Color) string {
+	return fmt.Sprintf("[fg %d %d %d %d %d]", color.Type, color.Index, color.Red, color.Green, color.Blue)
+}
+
+func (bracketRenderer) Background(color formatter.Color) string {
+	return fmt.Sprintf("[bg %d %d %d %d %d]", color.Type, color.Index, color.Red, color.Green, color.Blue)
+}
+
+func (bracketRenderer) Link(url, text string) string {
+	return "[" + text + "](" + url + ")"
+}
+
+func (bracketRenderer) Bell() string {
+	return "[bell]"
+}
+
+func TestFormatterSandboxed(test *testing.T) {
+	f := formatter.NewSandboxed()
+
+	assert.Equal(test, formatter.CapabilityNone, f.GetCapabilities())
+
+	for _, message := range []string{"{env \"HOME\"}", "a {hostname}", "{ip}", "{\"x\" | absolute}", `{expand "$HOME"}`} {
+		_, err := f.Format(message)
+
+		var formatError *formatter.FormatError
+
+		assert.True(test, errors.As(err, &formatError), message)
+		assert.True(test, errors.Is(err, formatter.ErrNotAllowed), message)
+		assert.True(test, errors.Is(err, formatter.ErrExecute), message)
+		assert.False(test, errors.Is(err, formatter.ErrUndefined), message)
+	}
+
+	_, err := f.Format("text {hostname}")
+
+	assert.Equal(test, `formatter: execute error at 1:7 in "hostname": function is not allowed`, err.Error())
+
+	formatted, err := f.Format("{upper p} {hostname}", "a", formatter.Named{"hostname": "b"})
+
+	assert.NoError(test, err)
+	assert.Equal(test, "A b", formatted)
+
+	formatted, err = f.AddFunction("env", func(string) string { return "x" }).Format(`{env "HOME"}`)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "x", formatted)
+
+	f.RemoveFunction("env").SetCapabilities(formatter.CapabilityEnv)
+
+	assert.True(test, f.GetCapabilities().Has(formatter.CapabilityEnv))
+	assert.False(test, f.GetCapabilities().Has(formatter.CapabilityOS))
+
+	formatted, err = f.Format(`{env "FORMATTER_SANDBOX_TEST"}`)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "", formatted)
+
+	_, err = f.Format("{pid}")
+
+	assert.True(test, errors.Is(err, formatter.ErrNotAllowed))
+
+	_, err = f.ResetCapabilities().Format("{pid}")
+
+	assert.NoError(test, err)
+	assert.Equal(test, formatter.CapabilityAll, f.GetCapabilities())
+}
+
+func TestFormatterLimits(test *testing.T) {
+	f := formatter.New().SetUnusedHandler(formatter.DropUnused)
+
+	items := make([]int, 100)
+
+	for _, tt := range []struct {
+		limits  formatter.Limits
+		message string
+		err     error
+		expect  string
+	}{
+		{formatter.Limits{MaxOutputBytes: 5}, "{range p}ab{end}", formatter.ErrOutputLimit, "ababa"},
+		{formatter.Limits{MaxOutputBytes: 200}, "{range p}ab{end}", nil, strings.Repeat("ab", 100)},
+		{formatter.Limits{MaxRangeIterations: 10}, "{range p}{end}", formatter.ErrRangeLimit, ""},
+		{formatter.Limits{MaxRangeIterations: 100}, "{range p}{end}", nil, ""},
+		{formatter.Limits{MaxRangeIterations: 150}, "{range p0}{range p0}{end}{end}", formatter.ErrRangeLimit, ""},
+		{formatter.Limits{MaxExecutionTime: time.Nanosecond}, "{range p}{sleep}{end}", formatter.ErrTimeLimit, ""},
+	} {
+		var buffer bytes.Buffer
+
+		f.SetLimits(tt.limits).AddFunction("sleep", func() string {
+			time.Sleep(time.Millisecond)
+			return ""
+		})
+
+		err := f.FormatWriter(&buffer, tt.message, items)
+
+		if tt.err != nil {
+			var formatError *formatter.FormatError
+
+			assert.True(test, errors.As(err, &formatError), tt.message)
+			assert.True(test, errors.Is(err, tt.err), tt.message)
+			assert.True(test, errors.Is(err, formatter.ErrExecute), tt.message)
+			assert.Equal(test, "formatter: execute error: "+tt.err.Error(), err.Error())
+		} else {
+			assert.NoError(test, err, tt.message)
+		}
+
+		assert.Equal(test, tt.expect, buffer.String(), tt.message)
+	}
+
+	f.SetLimits(formatter.Limits{MaxDepth: 2})
+
+	formatted, err := f.Format("{if true}{with 1}{.}{end}{end}")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "1", formatted)
+
+	_, err = f.Format("{if true}{with 1}{range p}{end}{end}{end}", items)
+
+	var formatError *formatter.FormatError
+
+	assert.True(test, errors.As(err, &formatError))
+	assert.True(test, errors.Is(err, formatter.ErrDepthLimit))
+	assert.True(test, errors.Is(err, formatter.ErrParse))
+	assert.Equal(test, 24, formatError.Offset)
+
+	_, err = f.SetLimits(formatter.Limits{MaxOutputBytes: 3}).EnableStrict().Format("{p}", "abcd")
+
+	assert.True(test, errors.Is(err, formatter.ErrOutputLimit))
+
+	formatted, err = f.DisableStrict().SetUnusedHandler(formatter.AppendUnused).Format("ab", "cd")
+
+	assert.True(test, errors.Is(err, formatter.ErrOutputLimit))
+	assert.Equal(test, "", formatted)
+
+	assert.Equal(test, formatter.Limits{MaxOutputBytes: 3}, f.GetLimits())
+	assert.Equal(test, formatter.Limits{}, f.ResetLimits().GetLimits())
+
+	f = formatter.NewSandboxed().SetLimits(formatter.Limits{MaxOutputBytes: 16})
+
+	for _, message := range []string{"{p:>400000000}", "{p:0400000000,}", "{p:.400000000f}", "ab{p:>15}", "{p:€>8}"} {
+		_, err := f.Format(message, 1)
+
+		assert.True(test, errors.Is(err, formatter.ErrOutputLimit), message)
+		assert.True(test, errors.Is(err, formatter.ErrExecute), message)
+	}
+
+	formatted, err = f.Format("a{p:*>15}", 1)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "a**************1", formatted)
+
+	var buffer bytes.Buffer
+
+	err = f.SetBackend(formatter.HTMLBackend).SetLimits(formatter.Limits{MaxOutputBytes: 20}).FormatWriter(&buffer, "{red}{p}{end}", "text")
+
+	assert.True(test, errors.Is(err, formatter.ErrOutputLimit))
+	assert.True(test, errors.Is(err, formatter.ErrExecute))
+	assert.Equal(test, `<span style="color:#`, buffer.String())
+}
+
+func TestFormatterEnvPolicy(test *testing.T) {
+	f := formatter.New().SetEnvironment(formatter.MapEnvironment(map[string]string{
+		"HOME":                  "/home/user",
+		"APP_NAME":              "demo",
+		"APP_DEBUG":             "1",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"DB_PASS":               "password",
+		"GITHUB_TOKEN":          "token",
+		"API_KEY_ID":            "id",
+		"KEYBOARD_LAYOUT":       "us",
+		"AUTHOR":                "me",
+		"XDG_SESSION_TYPE":      "wayland",
+	}))
+
+	assert.NotNil(test, f.GetEnvironment())
+
+	for _, tt := range []struct {
+		policy  formatter.EnvPolicy
+		message string
+		expect  string
+		err     error
+	}{
+		{formatter.EnvPolicy{}, `{env "HOME"}`, "/home/user", nil},
+		{formatter.EnvPolicy{}, `{env "MISSING"}`, "", nil},
+		{formatter.EnvPolicy{}, `{env "AWS_SECRET_ACCESS_KEY"}`, formatter.RedactedValue, nil},
+		{formatter.EnvPolicy{}, `{expand "$HOME:${AWS_SECRET_ACCESS_KEY}"}`, "/home/user:" + formatter.RedactedValue, nil},
+		{formatter.EnvPolicy{}, `{expand "$GITHUB_TOKEN $API_KEY_ID"}`, formatter.RedactedValue + " " + formatter.RedactedValue, nil},
+		{formatter.EnvPolicy{}, `{expand "$KEYBOARD_LAYOUT $AUTHOR $XDG_SESSION_TYPE"}`, "us me wayland", nil},
+		{formatter.EnvPolicy{DisableDefaultRedact: true}, `{env "AWS_SECRET_ACCESS_KEY"}`, "secret", nil},
+		{formatter.EnvPolicy{Redact: []string{"*_pass"}}, `{env "DB_PASS"}`, formatter.RedactedValue, nil},
+		{formatter.EnvPolicy{Allow: []string{"app_*"}}, `{env "APP_NAME"}`, "demo", nil},
+		{formatter.EnvPolicy{Allow: []string{"APP_*"}}, `{env "HOME"}`, "", formatter.ErrEnvNotAllowed},
+		{formatter.EnvPolicy{Allow: []string{"APP_*"}, Deny: []string{"*_DEBUG"}}, `{env "APP_DEBUG"}`, "", formatter.ErrEnvNotAllowed},
+		{formatter.EnvPolicy{Deny: []string{"HOME"}}, `{expand "$APP_NAME $HOME"}`, "", formatter.ErrEnvNotAllowed},
+		{formatter.EnvPolicy{Deny: []string{"["}}, `{env "HOME"}`, "", formatter.ErrFunction},
+	} {
+		formatted, err := f.SetEnvPolicy(tt.policy).Format(tt.message)
+
+		if tt.err != nil {
+			assert.True(test, errors.Is(err, tt.err), tt.message)
+			assert.True(test, errors.Is(err, formatter.ErrFunction), tt.message)
+		} else {
+			assert.NoError(test, err, tt.message)
+		}
+
+		assert.Equal(test, tt.expect, formatted, tt.message)
+	}
+
+	_, err := f.SetEnvPolicy(formatter.EnvPolicy{Allow: []string{"APP_*"}}).Format(`{env "HOME"}`)
+
+	assert.Equal(test, `formatter: function error at 1:2 in "env": environment variable is not allowed: "HOME"`, err.Error())
+	assert.Equal(test, formatter.EnvPolicy{Allow: []string{"APP_*"}}, f.GetEnvPolicy())
+
+	patterns := formatter.DefaultRedactPatterns()
+	patterns[0] = "HOME"
+
+	assert.NotEqual(test, "HOME", formatter.DefaultRedactPatterns()[0])
+	assert.Equal(test, formatter.EnvPolicy{}, f.ResetEnvPolicy().GetEnvPolicy())
+	assert.Nil(test, f.ResetEnvironment().GetEnvironment())
+}
+
+type contextKey string
+
+func TestFormatterFormatContext(test *testing.T) {
+	ctx := context.WithValue(context.Background(), contextKey("tenant"), "acme")
+	ctx = context.WithValue(ctx, "trace", "1234") // nolint: staticcheck, golint
+
+	f := formatter.New().AddFunctions(formatter.Functions{
+		"tenant": func(ctx context.Context) interface{} {
+			return ctx.Value(contextKey("tenant"))
+		},
+		"join": func(ctx context.Context, separator string, texts ...string) (string, error) {
+			return strings.Join(texts, separator) + ctx.Value(contextKey("tenant")).(string), nil
+		},
+	})
+
+	formatted, err := f.FormatContext(ctx, `{tenant} {ctx "trace"} {join "-" "a" "b"} {p | upper}`, "x")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "acme 1234 a-bacme X", formatted)
+
+	var buffer bytes.Buffer
+
+	assert.NoError(test, f.FormatWriterContext(ctx, &buffer, "{tenant}"))
+	assert.Equal(test, "acme", buffer.String())
+
+	formatted, err = f.Format(`{ctx "trace"}`)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "<no value>", formatted)
+
+	m := f.MustCompile("{tenant}: {p}")
+
+	formatted, err = m.FormatContext(ctx, 1)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "acme: 1", formatted)
+
+	buffer.Reset()
+
+	assert.NoError(test, m.FormatWriterContext(ctx, &buffer, 2))
+	assert.Equal(test, "acme: 2", buffer.String())
+
+	formatted, err = formatter.FormatContext(ctx, `{ctx "trace"}`)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "1234", formatted)
+
+	buffer.Reset()
+
+	assert.NoError(test, formatter.FormatWriterContext(ctx, &buffer, `{ctx "trace"}`))
+	assert.Equal(test, "1234", buffer.String())
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err = f.FormatContext(canceled, "text")
+
+	assert.True(test, errors.Is(err, context.Canceled))
+	assert.True(test, errors.Is(err, formatter.ErrExecute))
+
+	expired, cancel := context.WithTimeout(ctx, -time.Second)
+	defer cancel()
+
+	_, err = f.FormatContext(expired, "{tenant}")
+
+	assert.True(test, errors.Is(err, formatter.ErrTimeLimit))
+}
+
+func TestFormatterStyleRenderer(test *testing.T) {
+	f := formatter.New().EnableEscapeSequences().SetStyleRenderer(bracketRenderer{}).AddStyle("error", "bold red on white")
+
+	assert.Equal(test, bracketRenderer{}, f.GetStyleRenderer())
+
+	for _, tt := range []struct {
+		message string
+		expect  string
+	}{
+		{"{bold}a{bold | off}", "[bold]a[/bold]"},
+		{"{red | bright}a{normal}", "[fg 1 9 0 0 0]a[/]"},
+		{"{rgb 1 2 3 | background}", "[bg 3 0 1 2 3]"},
+		{"{ansi256 200}{default | foreground}", "[fg 2 200 0 0 0][fg 0 0 0 0 0]"},
+		{`{color "#ff0000"}`, "[fg 3 0 255 0 0]"},
+		{"{red}a{italic}b{end}c{end}", "[fg 1 1 0 0 0]a[italic]b[/][fg 1 1 0 0 0]c[/]"},
+		{"{error}a{end}", "[bold][fg 1 1 0 0 0][bg 1 7 0 0 0]a[/]"},
+		{`{link "https://go.dev" "Go"}{bell}`, "[Go](https://go.dev)[bell]"},
+	} {
+		formatted, err := f.Format(tt.message)
+
+		assert.NoError(test, err)
+		assert.Equal(test, tt.expect, formatted, tt.message)
+	}
+
+	formatted, err := f.DisableEscapeSequences().Format(`{red}a{end}{link "https://go.dev" "Go"}`)
+
+	assert.NoError(test, err)
+	assert.Equal(test, "[fg 1 1 0 0 0]a[/][Go](https://go.dev)", formatted)
+
+	colored, plain, err := f.FormatDual(`{bold}x{end} {link "https://go.dev" (p | red)}{bell}`, "Go")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "[bold]x[/] [[fg 1 1 0 0 0]Go[/]](https://go.dev)[bell]", colored)
+	assert.Equal(test, "x Go", plain)
+
+	colored, plain, err = f.MustCompile("{bold}{p}{end}").FormatDual("\x1b[1my")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "[bold]\x1b[1my[/]", colored)
+	assert.Equal(test, "y", plain)
+
+	formatted, err = f.EnableEscapeSequences().ResetStyleRenderer().SetColorProfile(formatter.ColorProfileANSI256).Format("{red}a{end}")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "\x1b[31ma\x1b[0m", formatted)
+	assert.Nil(test, f.GetStyleRenderer())
+
+	_, err = f.Format(`{"text" | bright}`)
+
+	assert.Error(test, err)
+}
+
+func TestFormatterANSIStyleRenderer(test *testing.T) {
+	for _, tt := range []struct {
+		profile formatter.ColorProfile
+		color   formatter.Color
+		expect  string
+	}{
+		{formatter.ColorProfileTrueColor, formatter.Color{}, "\x1b[49m"},
+		{formatter.ColorProfileTrueColor, formatter.ANSIColor(9), "\x1b[101m"},
+		{formatter.ColorProfileTrueColor, formatter.ANSI256Color(9), "\x1b[48;5;9m"},
+		{formatter.ColorProfileTrueColor, formatter.RGBColor(1, 2, 3), "\x1b[48;2;1;2;3m"},
+		{formatter.ColorProfileANSI256, formatter.RGBColor(255, 0, 0), "\x1b[48;5;196m"},
+		{formatter.ColorProfileANSI, formatter.ANSI256Color(196), "\x1b[101m"},
+		{formatter.ColorProfileNone, formatter.ANSIColor(1), ""},
+	} {
+		assert.Equal(test, tt.expect, formatter.ANSIStyleRenderer{Profile: tt.profile}.Background(tt.color))
+	}
+
+	renderer := formatter.ANSIStyleRenderer{}
+
+	assert.Equal(test, "\x1b[53m", renderer.Attribute(formatter.AttributeOverline))
+	assert.Equal(test, "\x1b[55m", renderer.AttributeOff(formatter.AttributeOverline))
+	assert.Equal(test, "strike", formatter.AttributeStrike.String())
+	assert.Equal(test, "unknown", formatter.Attribute(-1).String())
+	assert.Equal(test, "Go (https://go.dev)", formatter.NoopStyleRenderer{}.Link("https://go.dev", "Go"))
+}
+
+func TestFormatterTheme(test *testing.T) {
+	f := formatter.New().EnableEscapeSequences().SetColorProfile(formatter.ColorProfileANSI256)
+
+	assert.NoError(test, f.LoadTheme(strings.NewReader(`
+# Base styles
+error = bold red
+path  = underline cyan
+
+[light]
+error = bold ansi256(124)
+
+[dark]
+error = bold #FF5555
+`)))
+
+	formatted, err := f.Format("{error}{path}")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "\x1b[1m\x1b[31m\x1b[4m\x1b[36m", formatted)
+
+	formatted, err = f.SetVariant("light").Format("{error}{path}")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "\x1b[1m\x1b[38;5;124m\x1b[4m\x1b[36m", formatted)
+	assert.Equal(test, "light", f.GetVariant())
+	assert.Equal(test, "bold #FF5555", f.SetVariant("dark").GetStyle("error"))
+	assert.Equal(test, "bold red", f.ResetVariant().GetStyle("error"))
+
+	theme := f.GetTheme()
+	theme.Styles["error"] = "italic"
+
+	assert.Equal(test, "bold red", f.GetStyle("error"))
+	assert.Equal(test, "italic", f.SetTheme(theme).GetStyle("error"))
+
+	assert.NoError(test, f.LoadTheme(strings.NewReader("log-error = bold red\n")))
+
+	formatted, err = f.Format(`{style "log-error"}a{end} {p}`, "b")
+
+	assert.NoError(test, err)
+	assert.Equal(test, "\x1b[1m\x1b[31ma\x1b[0m b", formatted)
+
+	_, err = f.AddStyle("2fa", "green").Format("{log-error}")
+
+	assert.True(test, errors.Is(err, formatter.ErrParse))
+}
+
+func TestFormatterThemeError(test *testing.T) {
+	for _, text := range []string{"error bold red", "error = bold unknown", "error = on"} {
+		theme, err := formatter.ParseTheme(strings.NewReader(text))
+
+		assert.Error(test, err, text)
+		assert.Nil(test, theme)
+	}
+
+	assert.Error(test, formatter.New().LoadTheme(strings.NewReader("[dark]\nerror")))
+}
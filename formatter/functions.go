@@ -22,76 +22,14 @@ import (
 	"time"
 )
 
-var gDummyFunctions = template.FuncMap{ // nolint: gochecknoglobals
-	"reset":      setDummy,
-	"normal":     setDummy,
-	"default":    setDummy,
-	"bold":       setDummy,
-	"faint":      setDummy,
-	"italic":     setDummy,
-	"underline":  setDummy,
-	"overline":   setDummy,
-	"blink":      setDummy,
-	"invert":     setDummy,
-	"hide":       setDummy,
-	"strike":     setDummy,
-	"off":        setDummyTransform,
-	"bell":       setDummy,
-	"black":      setDummy,
-	"red":        setDummy,
-	"green":      setDummy,
-	"yellow":     setDummy,
-	"blue":       setDummy,
-	"magenta":    setDummy,
-	"cyan":       setDummy,
-	"white":      setDummy,
-	"gray":       setDummy,
-	"rgb":        setDummyRGB,
-	"bright":     setDummyTransform,
-	"background": setDummyTransform,
-	"foreground": setDummyTransform,
-	"color":      setDummyTransform,
-}
-
-var gEscapeFunctions = template.FuncMap{ // nolint: gochecknoglobals
-	"reset":      setNormal,
-	"normal":     setNormal,
-	"default":    setNormal,
-	"bold":       setBold,
-	"faint":      setFaint,
-	"italic":     setItalic,
-	"underline":  setUnderline,
-	"overline":   setOverline,
-	"blink":      setBlink,
-	"invert":     setInvert,
-	"hide":       setHide,
-	"strike":     setStrike,
-	"off":        setOff,
-	"bell":       setBell,
-	"black":      setBlack,
-	"red":        setRed,
-	"green":      setGreen,
-	"yellow":     setYellow,
-	"blue":       setBlue,
-	"magenta":    setMagenta,
-	"cyan":       setCyan,
-	"white":      setWhite,
-	"gray":       setGray,
-	"rgb":        setRGB,
-	"bright":     setBright,
-	"background": setBackground,
-	"foreground": setForeground,
-	"color":      setColor,
-}
-
 var gFunctions = template.FuncMap{ // nolint: gochecknoglobals
 	"ip":         getIPAddress,
+	"ips":        getIPAddresses,
+	"mac":        getMACAddress,
 	"user":       getUser,
 	"executable": os.Executable,
 	"cwd":        os.Getwd,
 	"hostname":   os.Hostname,
-	"env":        os.Getenv,
-	"expand":     os.ExpandEnv,
 	"uid":        os.Getuid,
 	"gid":        os.Getgid,
 	"euid":       os.Geteuid,
@@ -112,4 +50,6 @@ var gFunctions = template.FuncMap{ // nolint: gochecknoglobals
 	"json":       setJSON,
 	"indent":     setIndent,
 	"fields":     setFields,
+	"format":     setFormat,
+	"ctx":        getContextValue,
 }
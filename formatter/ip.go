@@ -16,22 +16,245 @@ package formatter
 
 import (
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-// Dial is used only in testing and mocking.
-var Dial = net.Dial // nolint: gochecknoglobals
+// These constants define scopes of IP addresses ordered by preference.
+const (
+	scopeGlobal = iota
+	scopeLinkLocal
+	scopeLoopback
+	scopeOther
+)
+
+// Interfaces is used only in testing and mocking.
+var Interfaces = getInterfaces // nolint: gochecknoglobals
+
+var gScopes = map[string]int{ // nolint: gochecknoglobals
+	"global":     scopeGlobal,
+	"link-local": scopeLinkLocal,
+	"loopback":   scopeLoopback,
+}
+
+var gFamilies = map[string]int{ // nolint: gochecknoglobals
+	"v4":   net.IPv4len,
+	"ipv4": net.IPv4len,
+	"v6":   net.IPv6len,
+	"ipv6": net.IPv6len,
+}
+
+// NetworkInterface defines network interface that is up with its addresses.
+type NetworkInterface struct {
+	Name         string
+	HardwareAddr net.HardwareAddr
+	Addresses    []net.IP
+}
+
+// ipAddress defines IP address of network interface.
+type ipAddress struct {
+	ip     net.IP
+	family int
+	scope  int
+	index  int
+}
+
+// ipFilter defines filters of IP addresses provided to ip, ips and mac functions.
+type ipFilter struct {
+	family int
+	scope  int
+	name   string
+}
+
+// getInterfaces returns network interfaces that are up with their addresses.
+func getInterfaces() ([]NetworkInterface, error) {
+	interfaces, err := net.Interfaces()
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]NetworkInterface, 0, len(interfaces))
+
+	for index := range interfaces {
+		i := &interfaces[index]
+
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
 
-func getIPAddress() string {
-	connection, err := Dial("udp", "8.8.8.8:80")
+		addresses, err := i.Addrs()
 
-	if connection == nil {
-		return "127.0.0.1"
+		if err != nil {
+			return nil, err
+		}
+
+		n := NetworkInterface{
+			Name:         i.Name,
+			HardwareAddr: i.HardwareAddr,
+		}
+
+		for _, address := range addresses {
+			if network, ok := address.(*net.IPNet); ok {
+				n.Addresses = append(n.Addresses, network.IP)
+			}
+		}
+
+		result = append(result, n)
+	}
+
+	return result, nil
+}
+
+// getIPAddress returns the best IP address of local network interfaces
+// matching filters. Global addresses are preferred over link-local and
+// loopback addresses and IPv4 addresses over IPv6 addresses.
+func getIPAddress(filters ...string) (string, error) {
+	addresses, _, err := findIPAddresses(filters)
+
+	if err != nil {
+		return "", err
+	}
+
+	return addresses[0].ip.String(), nil
+}
+
+// getIPAddresses returns all IP addresses of local network interfaces
+// matching filters ordered like in getIPAddress.
+func getIPAddresses(filters ...string) ([]string, error) {
+	addresses, _, err := findIPAddresses(filters)
+
+	if err != nil {
+		return nil, err
 	}
 
-	defer func() {
-		err = connection.Close()
-		_ = err
-	}()
+	result := make([]string, 0, len(addresses))
+
+	for _, address := range addresses {
+		result = append(result, address.ip.String())
+	}
+
+	return result, nil
+}
+
+// getMACAddress returns hardware address of local network interface with
+// the best IP address matching filters.
+func getMACAddress(filters ...string) (string, error) {
+	addresses, interfaces, err := findIPAddresses(filters)
 
-	return connection.LocalAddr().(*net.UDPAddr).IP.String()
+	if err != nil {
+		return "", err
+	}
+
+	hardware := interfaces[addresses[0].index].HardwareAddr
+
+	if len(hardware) == 0 {
+		return "", fError("interface " + strconv.Quote(interfaces[addresses[0].index].Name) + " has no hardware address")
+	}
+
+	return hardware.String(), nil
+}
+
+// findIPAddresses returns sorted IP addresses matching filters and all
+// network interfaces. It returns an error if there is no matching address.
+func findIPAddresses(filters []string) ([]ipAddress, []NetworkInterface, error) {
+	filter := parseIPFilter(filters)
+
+	interfaces, err := Interfaces()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var addresses []ipAddress
+
+	for index, i := range interfaces {
+		if (filter.name != "") && (filter.name != i.Name) {
+			continue
+		}
+
+		for _, ip := range i.Addresses {
+			address := ipAddress{
+				ip:     ip,
+				family: net.IPv6len,
+				scope:  getIPScope(ip),
+				index:  index,
+			}
+
+			if ip.To4() != nil {
+				address.family = net.IPv4len
+			}
+
+			if filter.matches(address) {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	if (len(addresses) == 0) && (len(filters) == 0) {
+		return nil, nil, fError("no IP address found")
+	}
+
+	if len(addresses) == 0 {
+		return nil, nil, fError("no IP address matching " + strconv.Quote(strings.Join(filters, " ")) + " found")
+	}
+
+	sort.SliceStable(addresses, func(i, j int) bool {
+		if addresses[i].scope != addresses[j].scope {
+			return addresses[i].scope < addresses[j].scope
+		}
+
+		return addresses[i].family < addresses[j].family
+	})
+
+	return addresses, interfaces, nil
+}
+
+// parseIPFilter parses filters like v4, v6, global, link-local, loopback
+// or interface name.
+func parseIPFilter(filters []string) ipFilter {
+	filter := ipFilter{
+		scope: -1,
+	}
+
+	for _, f := range filters {
+		if family, ok := gFamilies[strings.ToLower(f)]; ok {
+			filter.family = family
+		} else if scope, ok := gScopes[strings.ToLower(f)]; ok {
+			filter.scope = scope
+		} else {
+			filter.name = f
+		}
+	}
+
+	return filter
+}
+
+// matches returns true if address matches filter. Addresses with scope
+// other than global, link-local and loopback like multicast never match.
+func (f ipFilter) matches(address ipAddress) bool {
+	switch {
+	case address.scope == scopeOther:
+		return false
+	case (f.family != 0) && (f.family != address.family):
+		return false
+	case (f.scope >= 0) && (f.scope != address.scope):
+		return false
+	default:
+		return true
+	}
+}
+
+func getIPScope(ip net.IP) int {
+	switch {
+	case ip.IsLoopback():
+		return scopeLoopback
+	case ip.IsLinkLocalUnicast():
+		return scopeLinkLocal
+	case ip.IsGlobalUnicast():
+		return scopeGlobal
+	default:
+		return scopeOther
+	}
 }
@@ -0,0 +1,249 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"text/template/parse"
+	"time"
+)
+
+// iterationFunction is called at the beginning of every range iteration.
+const iterationFunction = "_iteration"
+
+// Limits defines limits of message execution. Zero value means no limit.
+type Limits struct {
+	// MaxOutputBytes limits number of bytes written by formatted message
+	// including appended unused arguments. Exceeding it returns
+	// ErrOutputLimit error. Bytes up to the limit are written to writer.
+	// Format specification with width above remaining bytes returns
+	// ErrOutputLimit error before padding is built. With backend, it limits
+	// both formatted message and output rendered by backend.
+	MaxOutputBytes int
+
+	// MaxExecutionTime limits time of message execution. Exceeding it
+	// returns ErrTimeLimit error. It is checked on every write and on every
+	// range iteration, it cannot interrupt a long running custom function.
+	MaxExecutionTime time.Duration
+
+	// MaxDepth limits nesting depth of if, range and with blocks. Exceeding
+	// it returns ErrDepthLimit error when message is parsed.
+	MaxDepth int
+
+	// MaxRangeIterations limits total number of range iterations in all
+	// range blocks. Exceeding it returns ErrRangeLimit error.
+	MaxRangeIterations int
+}
+
+// limiterKey is context key of limiter used by functions like format.
+type limiterKey struct{}
+
+// limiter tracks limits during single execution of message.
+type limiter struct {
+	ctx        context.Context
+	limits     Limits
+	written    int
+	iterations int
+}
+
+type limitWriter struct {
+	limiter *limiter
+	writer  io.Writer
+}
+
+// newLimiter returns limiter for single execution of message and function
+// that releases resources associated with it.
+func newLimiter(ctx context.Context, limits Limits) (*limiter, context.CancelFunc) {
+	cancel := context.CancelFunc(func() {})
+
+	if limits.MaxExecutionTime > 0 {
+		ctx, cancel = context.WithTimeout(ctx, limits.MaxExecutionTime)
+	}
+
+	return &limiter{
+		ctx:    ctx,
+		limits: limits,
+	}, cancel
+}
+
+// writer returns writer that counts written bytes and checks execution time.
+func (l *limiter) writer(writer io.Writer) io.Writer {
+	return &limitWriter{
+		limiter: l,
+		writer:  writer,
+	}
+}
+
+// context returns context of execution with limiter.
+func (l *limiter) context() context.Context {
+	return context.WithValue(l.ctx, limiterKey{}, l)
+}
+
+// remaining returns number of bytes that can be written before output
+// limit is exceeded. It returns -1 without output limit.
+func (l *limiter) remaining() int {
+	if l.limits.MaxOutputBytes <= 0 {
+		return -1
+	}
+
+	return l.limits.MaxOutputBytes - l.written
+}
+
+// iterate counts range iterations and checks execution time.
+func (l *limiter) iterate() (string, error) {
+	if err := l.check(); err != nil {
+		return "", err
+	}
+
+	l.iterations++
+
+	if (l.limits.MaxRangeIterations > 0) && (l.iterations > l.limits.MaxRangeIterations) {
+		return "", ErrRangeLimit
+	}
+
+	return "", nil
+}
+
+// check returns an error when execution time is exceeded or execution was canceled.
+func (l *limiter) check() error {
+	err := l.ctx.Err()
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeLimit
+	}
+
+	return err
+}
+
+// Write writes data up to the output limit.
+func (w *limitWriter) Write(data []byte) (int, error) {
+	if err := w.limiter.check(); err != nil {
+		return 0, err
+	}
+
+	var err error
+
+	if limit := w.limiter.limits.MaxOutputBytes; (limit > 0) && (w.limiter.written+len(data) > limit) {
+		data = data[:limit-w.limiter.written]
+		err = ErrOutputLimit
+	}
+
+	n, werr := w.writer.Write(data)
+	w.limiter.written += n
+
+	if werr != nil {
+		return n, werr
+	}
+
+	return n, err
+}
+
+// guard checks nesting depth of blocks and adds iteration function call
+// at the beginning of every range block.
+func (c *compiled) guard(maxDepth int) error {
+	for _, t := range c.template.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+
+		if node := guard(t.Tree.Root, 0, maxDepth); node != nil {
+			return newDepthError(c, int(node.Position()))
+		}
+	}
+
+	return nil
+}
+
+// guard returns the first block node that exceeds maximum nesting depth.
+func guard(node parse.Node, depth, maxDepth int) parse.Node {
+	var branch *parse.BranchNode
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			for _, item := range n.Nodes {
+				if exceeded := guard(item, depth, maxDepth); exceeded != nil {
+					return exceeded
+				}
+			}
+		}
+
+		return nil
+	case *parse.IfNode:
+		branch = &n.BranchNode
+	case *parse.WithNode:
+		branch = &n.BranchNode
+	case *parse.RangeNode:
+		branch = &n.BranchNode
+
+		if branch.List != nil {
+			branch.List.Nodes = append([]parse.Node{newIteration(n.Pos, n.Line)}, branch.List.Nodes...)
+		}
+	default:
+		return nil
+	}
+
+	if depth++; (maxDepth > 0) && (depth > maxDepth) {
+		return node
+	}
+
+	if exceeded := guard(branch.List, depth, maxDepth); exceeded != nil {
+		return exceeded
+	}
+
+	return guard(branch.ElseList, depth, maxDepth)
+}
+
+// newIteration returns action that calls iteration function.
+func newIteration(pos parse.Pos, line int) *parse.ActionNode {
+	return &parse.ActionNode{
+		NodeType: parse.NodeAction,
+		Pos:      pos,
+		Line:     line,
+		Pipe: &parse.PipeNode{
+			NodeType: parse.NodePipe,
+			Pos:      pos,
+			Line:     line,
+			Cmds: []*parse.CommandNode{{
+				NodeType: parse.NodeCommand,
+				Pos:      pos,
+				Args:     []parse.Node{parse.NewIdentifier(iterationFunction).SetPos(pos)},
+			}},
+		},
+	}
+}
+
+// getRemainingOutput returns number of bytes that can be written by
+// execution bound to ctx. It returns -1 without output limit.
+func getRemainingOutput(ctx context.Context) int {
+	if l, ok := ctx.Value(limiterKey{}).(*limiter); ok {
+		return l.remaining()
+	}
+
+	return -1
+}
+
+// getLimitError returns limit error or context error that stopped execution.
+func getLimitError(err error) error {
+	for _, limit := range []error{ErrOutputLimit, ErrTimeLimit, ErrRangeLimit, context.Canceled} {
+		if errors.Is(err, limit) {
+			return limit
+		}
+	}
+
+	return nil
+}
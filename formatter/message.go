@@ -0,0 +1,336 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"text/template"
+	"unicode"
+)
+
+// Message defines a precompiled message created by Compile. It is immutable
+// and it can be safely formatted from many goroutines.
+type Message struct {
+	compiled *compiled
+	config   config
+}
+
+// String returns message used to create precompiled message.
+func (m *Message) String() string {
+	return m.compiled.message
+}
+
+// Format formats precompiled message.
+func (m *Message) Format(arguments ...interface{}) (string, error) {
+	return m.FormatContext(context.Background(), arguments...)
+}
+
+// FormatContext formats precompiled message with context. See
+// Formatter.FormatContext for details.
+func (m *Message) FormatContext(ctx context.Context, arguments ...interface{}) (string, error) {
+	var buffer bytes.Buffer
+
+	if err := m.FormatWriterContext(ctx, &buffer, arguments...); err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
+
+// MustFormat is like Format but panics if precompiled message cannot be formatted.
+func (m *Message) MustFormat(arguments ...interface{}) string {
+	formatted, err := m.Format(arguments...)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return formatted
+}
+
+// FormatWriter formats precompiled message to writer. In EscapeSequencesAuto
+// mode precompiled message is parsed again when destination writer support of
+// ANSI escape sequences is different than at compile time. With backend,
+// message is formatted with ANSI escape sequences rendered by backend.
+func (m *Message) FormatWriter(writer io.Writer, arguments ...interface{}) error {
+	return m.FormatWriterContext(context.Background(), writer, arguments...)
+}
+
+// FormatWriterContext formats precompiled message to writer with context.
+// See Formatter.FormatContext for details.
+func (m *Message) FormatWriterContext(ctx context.Context, writer io.Writer, arguments ...interface{}) error {
+	if m.config.backend != nil {
+		return m.render(ctx, writer, arguments)
+	}
+
+	c, err := m.resolve(writer)
+
+	if err != nil {
+		return err
+	}
+
+	return m.execute(ctx, writer, c, arguments)
+}
+
+// FormatDual formats precompiled message once and returns both colored
+// rendering with ANSI escape sequences and plain rendering without them.
+// See Formatter.FormatDual for details.
+func (m *Message) FormatDual(arguments ...interface{}) (colored, plain string, err error) {
+	c, err := m.dual()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	var buffer bytes.Buffer
+
+	if err := m.execute(context.Background(), &buffer, c, arguments); err != nil {
+		return "", "", err
+	}
+
+	return resolveDual(buffer.String(), false), StripEscapeSequences(resolveDual(buffer.String(), true)), nil
+}
+
+// render formats precompiled message with true color ANSI escape sequences
+// and writes it rendered by backend to writer.
+func (m *Message) render(ctx context.Context, writer io.Writer, arguments []interface{}) error {
+	c, err := m.rendered()
+
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+
+	if err := m.execute(ctx, &buffer, c, arguments); err != nil {
+		return err
+	}
+
+	text, err := m.config.backend(buffer.String())
+
+	if err != nil {
+		return newWriterError(c.message, err)
+	}
+
+	limiter, cancel := newLimiter(ctx, Limits{MaxOutputBytes: m.config.limits.MaxOutputBytes})
+	defer cancel()
+
+	if err := write(limiter.writer(writer), text); err != nil {
+		return newWriterError(c.message, err)
+	}
+
+	return nil
+}
+
+// dual returns parsed message with styles rendered for FormatDual.
+func (m *Message) dual() (*compiled, error) {
+	if m.compiled.target == renderDual {
+		return m.compiled, nil
+	}
+
+	return m.config.lookupDual(m.compiled.message)
+}
+
+// rendered returns parsed message with ANSI escape sequences for backend.
+func (m *Message) rendered() (*compiled, error) {
+	if m.compiled.target == renderBackend {
+		return m.compiled, nil
+	}
+
+	return m.config.lookupBackend(m.compiled.message)
+}
+
+// resolve returns parsed message with escape sequences allowed or removed for writer.
+func (m *Message) resolve(writer io.Writer) (*compiled, error) {
+	escapeSequences := m.config.escapeSequencesFor(writer).Enabled
+
+	if (m.compiled.target != renderWriter) || (escapeSequences != m.compiled.escapeSequences) {
+		return m.config.lookup(m.compiled.message, escapeSequences)
+	}
+
+	return m.compiled, nil
+}
+
+func (m *Message) execute(ctx context.Context, writer io.Writer, c *compiled, arguments []interface{}) error {
+	var object interface{}
+
+	limiter, cancel := newLimiter(ctx, m.config.limits)
+	defer cancel()
+
+	var objectPosition int
+
+	used := make(map[int]bool)
+	placeholders := make(template.FuncMap)
+	placeholders[m.config.placeholder] = argumentAutomatic(used, arguments, m.config.strict)
+
+	for position, argument := range arguments {
+		placeholder := m.config.placeholder + strconv.Itoa(position)
+		placeholders[placeholder] = argumentValue(used, position, argument)
+		valueOf := reflect.ValueOf(argument)
+
+		switch valueOf.Kind() {
+		case reflect.Map:
+			if reflect.TypeOf(argument).Key().Kind() == reflect.String {
+				for _, key := range valueOf.MapKeys() {
+					if isIdentifier(key.String()) {
+						placeholders[key.String()] = argumentValue(used, position, valueOf.MapIndex(key).Interface())
+					}
+				}
+			}
+		case reflect.Struct:
+			object = argument
+			objectPosition = position
+		case reflect.Ptr:
+			if isObjectPointer(valueOf) {
+				object = argument
+				objectPosition = position
+			}
+		}
+	}
+
+	ctx = limiter.context()
+
+	t, err := c.bind(ctx, placeholders, template.FuncMap{
+		iterationFunction: limiter.iterate,
+		formatFunction: func(specification string, value interface{}) (string, error) {
+			return setFormat(ctx, specification, value)
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+
+	output := writer
+
+	if m.config.strict {
+		output = &buffer
+	}
+
+	if err := t.Execute(m.writer(c, limiter, output), object); err != nil {
+		return newExecuteError(c, err)
+	}
+
+	if err := m.objectUsed(used, objectPosition, object); err != nil {
+		return err
+	}
+
+	if m.config.strict {
+		if err := m.handleUnused(writer, ErrorUnused, used, arguments); err != nil {
+			return err
+		}
+
+		if err := write(writer, buffer.String()); err != nil {
+			return newWriterError(m.compiled.message, err)
+		}
+
+		return nil
+	}
+
+	return m.handleUnused(m.writer(c, limiter, writer), m.config.unused, used, arguments)
+}
+
+// writer returns writer limited by limiter. For backend it removes escape
+// characters of formatted values that are not rendered by backendRenderer.
+func (m *Message) writer(c *compiled, limiter *limiter, writer io.Writer) io.Writer {
+	writer = limiter.writer(writer)
+
+	if c.target == renderBackend {
+		writer = escapeWriter{writer: writer}
+	}
+
+	return writer
+}
+
+// handleUnused passes all unused arguments to provided handler.
+func (m *Message) handleUnused(writer io.Writer, handler UnusedHandler, used map[int]bool, arguments []interface{}) error {
+	var unused []Unused
+
+	for position, argument := range arguments {
+		if !used[position] {
+			unused = append(unused, Unused{
+				Name:     m.config.placeholder + strconv.Itoa(position),
+				Position: position,
+				Argument: argument,
+			})
+		}
+	}
+
+	if len(unused) == 0 {
+		return nil
+	}
+
+	if handler == nil {
+		handler = AppendUnused
+	}
+
+	err := handler(writer, m.compiled.message, unused)
+
+	var formatError *FormatError
+
+	if (err != nil) && !errors.As(err, &formatError) {
+		return &FormatError{
+			Kind:        ExecuteError,
+			Message:     m.compiled.message,
+			Description: err.Error(),
+			Offset:      -1,
+			Err:         err,
+		}
+	}
+
+	return err
+}
+
+func (m *Message) objectUsed(used map[int]bool, position int, object interface{}) (err error) {
+	if (object == nil) || used[position] {
+		return nil
+	}
+
+	var r *regexp.Regexp
+
+	if r, err = regexp.Compile(m.compiled.leftDelimiter + `\s*(\.|[^\.].* \.).+` + m.compiled.rightDelimiter); err != nil {
+		return &FormatError{
+			Kind:        ExecuteError,
+			Message:     m.compiled.message,
+			Description: err.Error(),
+			Offset:      -1,
+			Err:         err,
+		}
+	}
+
+	used[position] = r.MatchString(m.compiled.text)
+
+	return nil
+}
+
+// isIdentifier returns true if name can be used as a named placeholder.
+// Other map keys like "user id" cannot be referenced by message.
+func isIdentifier(name string) bool {
+	for index, r := range name {
+		if (r != '_') && !unicode.IsLetter(r) && ((index == 0) || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+
+	return name != ""
+}
@@ -0,0 +1,508 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// These constants define text attributes passed to style renderer.
+const (
+	AttributeBold Attribute = iota
+	AttributeFaint
+	AttributeItalic
+	AttributeUnderline
+	AttributeOverline
+	AttributeBlink
+	AttributeInvert
+	AttributeHide
+	AttributeStrike
+)
+
+// These constants define types of colors passed to style renderer.
+const (
+	// ColorDefault is the default foreground or background color.
+	ColorDefault ColorType = iota
+
+	// ColorANSI is one of 16 standard and bright colors with index 0-15.
+	ColorANSI
+
+	// ColorANSI256 is a color from 256 colors palette with index 0-255.
+	ColorANSI256
+
+	// ColorRGB is a 24-bit color.
+	ColorRGB
+)
+
+const (
+	valueReset styleValueKind = iota
+	valueAttribute
+	valueAttributeOff
+	valueForeground
+	valueBackground
+)
+
+var gAttributes = map[string]Attribute{ // nolint: gochecknoglobals
+	"bold":      AttributeBold,
+	"faint":     AttributeFaint,
+	"italic":    AttributeItalic,
+	"underline": AttributeUnderline,
+	"overline":  AttributeOverline,
+	"blink":     AttributeBlink,
+	"invert":    AttributeInvert,
+	"hide":      AttributeHide,
+	"strike":    AttributeStrike,
+}
+
+var gColors = map[string]int{ // nolint: gochecknoglobals
+	"black":   0,
+	"red":     1,
+	"green":   2,
+	"yellow":  3,
+	"blue":    4,
+	"magenta": 5,
+	"cyan":    6,
+	"white":   7,
+	"gray":    8,
+}
+
+var gResets = []string{"reset", "normal", "default"} // nolint: gochecknoglobals
+
+// StyleRenderer renders text attributes, colors and hyperlinks used by
+// built-in functions like bold, red, rgb or link. Reset must end all
+// text attributes and colors.
+type StyleRenderer interface {
+	Reset() string
+	Attribute(attribute Attribute) string
+	AttributeOff(attribute Attribute) string
+	Foreground(color Color) string
+	Background(color Color) string
+	Link(url, text string) string
+	Bell() string
+}
+
+// Attribute defines text attribute like bold or italic.
+type Attribute int
+
+// ColorType defines type of color.
+type ColorType int
+
+// Color defines color passed to style renderer. Index is used by ColorANSI
+// and ColorANSI256 colors. Red, Green and Blue are used by ColorRGB colors.
+// Zero value is the default color.
+type Color struct {
+	Type  ColorType
+	Index int
+	Red   uint8
+	Green uint8
+	Blue  uint8
+}
+
+// NoopStyleRenderer renders nothing. Hyperlinks are rendered as text
+// followed by URL in parentheses or URL only when text is the same as URL.
+// It is used when ANSI escape sequences are disabled and no custom style
+// renderer is set.
+type NoopStyleRenderer struct{}
+
+// styleValue defines value returned by built-in style functions. It is
+// printed using style renderer. Functions like bright or background use
+// it to transform style.
+type styleValue struct {
+	renderer  StyleRenderer
+	kind      styleValueKind
+	attribute Attribute
+	color     Color
+}
+
+type styleValueKind int
+
+// String returns name of text attribute.
+func (a Attribute) String() string {
+	switch a {
+	case AttributeBold:
+		return "bold"
+	case AttributeFaint:
+		return "faint"
+	case AttributeItalic:
+		return "italic"
+	case AttributeUnderline:
+		return "underline"
+	case AttributeOverline:
+		return "overline"
+	case AttributeBlink:
+		return "blink"
+	case AttributeInvert:
+		return "invert"
+	case AttributeHide:
+		return "hide"
+	case AttributeStrike:
+		return "strike"
+	default:
+		return "unknown"
+	}
+}
+
+// ANSIColor returns one of 16 standard and bright colors.
+func ANSIColor(index int) Color {
+	return Color{Type: ColorANSI, Index: index}
+}
+
+// ANSI256Color returns color from 256 colors palette.
+func ANSI256Color(index int) Color {
+	return Color{Type: ColorANSI256, Index: index}
+}
+
+// RGBColor returns 24-bit color.
+func RGBColor(red, green, blue uint8) Color {
+	return Color{Type: ColorRGB, Red: red, Green: green, Blue: blue}
+}
+
+// Reset returns empty string.
+func (NoopStyleRenderer) Reset() string {
+	return ""
+}
+
+// Attribute returns empty string.
+func (NoopStyleRenderer) Attribute(Attribute) string {
+	return ""
+}
+
+// AttributeOff returns empty string.
+func (NoopStyleRenderer) AttributeOff(Attribute) string {
+	return ""
+}
+
+// Foreground returns empty string.
+func (NoopStyleRenderer) Foreground(Color) string {
+	return ""
+}
+
+// Background returns empty string.
+func (NoopStyleRenderer) Background(Color) string {
+	return ""
+}
+
+// Link returns text followed by URL in parentheses or URL only when text
+// is the same as URL.
+func (NoopStyleRenderer) Link(url, text string) string {
+	if text != url {
+		return text + " (" + url + ")"
+	}
+
+	return url
+}
+
+// Bell returns empty string.
+func (NoopStyleRenderer) Bell() string {
+	return ""
+}
+
+// String returns style rendered by style renderer.
+func (v styleValue) String() string {
+	switch v.kind {
+	case valueAttribute:
+		return v.renderer.Attribute(v.attribute)
+	case valueAttributeOff:
+		return v.renderer.AttributeOff(v.attribute)
+	case valueForeground:
+		return v.renderer.Foreground(v.color)
+	case valueBackground:
+		return v.renderer.Background(v.color)
+	default:
+		return v.renderer.Reset()
+	}
+}
+
+// getRendererFunctions returns built-in style functions that use renderer.
+func getRendererFunctions(renderer StyleRenderer) template.FuncMap {
+	functions := template.FuncMap{
+		"rgb": func(red, green, blue uint8) styleValue {
+			return styleValue{renderer: renderer, kind: valueForeground, color: RGBColor(red, green, blue)}
+		},
+		"ansi256": func(index int) (styleValue, error) {
+			if (index < 0) || (index > ansi256GrayLast) {
+				return styleValue{}, fError("color index must be between 0 and 255")
+			}
+
+			return styleValue{renderer: renderer, kind: valueForeground, color: ANSI256Color(index)}, nil
+		},
+		"color": func(in string) (styleValue, error) {
+			return parseColor(renderer, in)
+		},
+		"link": func(url string, text ...interface{}) string {
+			url = getLinkURL(url)
+
+			if len(text) == 0 {
+				return renderer.Link(url, url)
+			}
+
+			return renderer.Link(url, fmt.Sprint(text...))
+		},
+		"bell":       renderer.Bell,
+		"bright":     setBright,
+		"background": setBackground,
+		"foreground": setForeground,
+		"off":        setOff,
+	}
+
+	for _, name := range gResets {
+		functions[name] = func() styleValue {
+			return styleValue{renderer: renderer, kind: valueReset}
+		}
+	}
+
+	for name, attribute := range gAttributes {
+		value := styleValue{renderer: renderer, kind: valueAttribute, attribute: attribute}
+
+		functions[name] = func() styleValue {
+			return value
+		}
+	}
+
+	for name, index := range gColors {
+		value := styleValue{renderer: renderer, kind: valueForeground, color: ANSIColor(index)}
+
+		functions[name] = func() styleValue {
+			return value
+		}
+	}
+
+	return functions
+}
+
+// parseColor returns foreground color from color name like red or tomato,
+// RGB HEX value, CSS rgb() or hsl() function or 256 colors palette index.
+// Names reset, normal and default give reset.
+func parseColor(renderer StyleRenderer, in string) (styleValue, error) {
+	value := styleValue{renderer: renderer, kind: valueForeground}
+
+	in = strings.TrimSpace(strings.ToLower(in))
+
+	for _, name := range gResets {
+		if in == name {
+			return styleValue{renderer: renderer, kind: valueReset}, nil
+		}
+	}
+
+	if index, ok := gColors[in]; ok {
+		value.color = ANSIColor(index)
+		return value, nil
+	}
+
+	if strings.HasPrefix(in, "0x") {
+		color, err := strconv.ParseUint(strings.TrimPrefix(in, "0x"), 16, 24)
+
+		if err != nil {
+			return styleValue{}, err
+		}
+
+		value.color = RGBColor(uint8(color>>redOffset), uint8(color>>greenOffset), uint8(color))
+
+		return value, nil
+	}
+
+	if strings.HasPrefix(in, "ansi256(") && strings.HasSuffix(in, ")") {
+		index, err := strconv.Atoi(strings.TrimSpace(in[len("ansi256(") : len(in)-1]))
+
+		if err != nil {
+			return styleValue{}, err
+		}
+
+		if (index < 0) || (index > ansi256GrayLast) {
+			return styleValue{}, fError("color index must be between 0 and 255")
+		}
+
+		value.color = ANSI256Color(index)
+
+		return value, nil
+	}
+
+	red, green, blue, ok, err := parseCSSColor(in)
+
+	if err != nil {
+		return styleValue{}, err
+	}
+
+	if !ok {
+		return styleValue{}, fError("color is not supported")
+	}
+
+	value.color = RGBColor(red, green, blue)
+
+	return value, nil
+}
+
+// setBright makes standard color bright. Other colors are not changed.
+func setBright(in styleValue) (styleValue, error) {
+	if (in.kind != valueForeground) && (in.kind != valueBackground) {
+		return styleValue{}, fError("bright can be used only with colors")
+	}
+
+	if ((in.color.Type == ColorANSI) || (in.color.Type == ColorANSI256)) && (in.color.Index < 8) {
+		in.color.Index += 8
+	}
+
+	return in, nil
+}
+
+// setBackground makes color a background color. Reset gives the default
+// background color.
+func setBackground(in styleValue) (styleValue, error) {
+	switch in.kind {
+	case valueReset:
+		in.color = Color{}
+	case valueForeground, valueBackground:
+	default:
+		return styleValue{}, fError("background can be used only with colors")
+	}
+
+	in.kind = valueBackground
+
+	return in, nil
+}
+
+// setForeground makes color a foreground color. Reset gives the default
+// foreground color.
+func setForeground(in styleValue) (styleValue, error) {
+	switch in.kind {
+	case valueReset:
+		in.color = Color{}
+	case valueForeground, valueBackground:
+	default:
+		return styleValue{}, fError("foreground can be used only with colors")
+	}
+
+	in.kind = valueForeground
+
+	return in, nil
+}
+
+// setOff disables text attribute.
+func setOff(in styleValue) (styleValue, error) {
+	if (in.kind != valueAttribute) && (in.kind != valueAttributeOff) {
+		return styleValue{}, fError("off can be used only with text attributes")
+	}
+
+	in.kind = valueAttributeOff
+
+	return in, nil
+}
+
+func getLinkURL(url string) string {
+	return strings.Map(func(r rune) rune {
+		if (r < ' ') || (r > '~') {
+			return -1
+		}
+
+		return r
+	}, url)
+}
+
+// dualRenderer renders styles using provided renderer. Each rendered style
+// is marked with its plain rendering, so that both colored and plain
+// renderings can be resolved from the same formatted message.
+type dualRenderer struct {
+	renderer StyleRenderer
+}
+
+// Reset returns marked style that ends all text attributes and colors.
+func (r dualRenderer) Reset() string {
+	return markDual(r.renderer.Reset(), "")
+}
+
+// Attribute returns marked style that enables text attribute.
+func (r dualRenderer) Attribute(attribute Attribute) string {
+	return markDual(r.renderer.Attribute(attribute), "")
+}
+
+// AttributeOff returns marked style that disables text attribute.
+func (r dualRenderer) AttributeOff(attribute Attribute) string {
+	return markDual(r.renderer.AttributeOff(attribute), "")
+}
+
+// Foreground returns marked style that sets foreground color.
+func (r dualRenderer) Foreground(color Color) string {
+	return markDual(r.renderer.Foreground(color), "")
+}
+
+// Background returns marked style that sets background color.
+func (r dualRenderer) Background(color Color) string {
+	return markDual(r.renderer.Background(color), "")
+}
+
+// Link returns marked hyperlink to URL with text. Text is not marked when
+// renderer passes it unchanged, so that plain rendering contains text only.
+func (r dualRenderer) Link(url, text string) string {
+	placeholder := "text" + gEscapeMarker
+	link := r.renderer.Link(url, placeholder)
+
+	if index := strings.Index(link, placeholder); index >= 0 {
+		return markDual(link[:index], "") + text + markDual(link[index+len(placeholder):], "")
+	}
+
+	return markDual(r.renderer.Link(url, resolveDual(text, false)), resolveDual(text, true))
+}
+
+// Bell returns marked bell.
+func (r dualRenderer) Bell() string {
+	return markDual(r.renderer.Bell(), "")
+}
+
+// markDual returns colored and plain renderings of style marked by
+// gEscapeMarker.
+func markDual(colored, plain string) string {
+	return string(escape) + gEscapeMarker + "{" + colored + string(escape) + gEscapeMarker + "|" +
+		plain + string(escape) + gEscapeMarker + "}"
+}
+
+// resolveDual returns colored or plain rendering of text with styles
+// marked by markDual.
+func resolveDual(text string, plain bool) string {
+	start, separator, end := string(escape)+gEscapeMarker+"{", string(escape)+gEscapeMarker+"|", string(escape)+gEscapeMarker+"}"
+
+	var builder strings.Builder
+
+	for {
+		first := strings.Index(text, start)
+
+		if first < 0 {
+			break
+		}
+
+		last := strings.Index(text[first:], end)
+		middle := strings.Index(text[first:], separator)
+
+		if (last < 0) || (middle < 0) || (middle > last) {
+			break
+		}
+
+		builder.WriteString(text[:first])
+
+		if plain {
+			builder.WriteString(text[first+middle+len(separator) : first+last])
+		} else {
+			builder.WriteString(text[first+len(start) : first+middle])
+		}
+
+		text = text[first+last+len(end):]
+	}
+
+	builder.WriteString(text)
+
+	return builder.String()
+}
@@ -0,0 +1,424 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	trimMarker      = '-'
+	commentStart    = "/*"
+	commentEnd      = "*/"
+	formatSeparator = ':'
+	keywordEnd      = "end"
+)
+
+// gBlockKeywords defines keywords that start control blocks closed by {end}.
+var gBlockKeywords = map[string]bool{ // nolint: gochecknoglobals
+	"if":     true,
+	"range":  true,
+	"with":   true,
+	"block":  true,
+	"define": true,
+}
+
+// span maps part of rewritten text copied from original message.
+type span struct {
+	text    int
+	message int
+	length  int
+}
+
+// rewritten defines message translated to template understood by text/template.
+type rewritten struct {
+	builder strings.Builder
+	spans   []span
+	styles  map[string]styleKind
+	blocks  []bool
+}
+
+// rewrite translates message to template understood by text/template.
+// Replacement fields with format specification like {p:>10} are translated
+// to pipelines like {p | _format ">10"}. Doubled delimiters like {{ and }}
+// outside of replacement fields are translated to literal delimiters.
+// The {end} action that closes style scope like {red}, {error} or
+// {style "error"} instead of control block is translated to {endStyle}
+// that ends style and restores enclosing styles.
+func rewrite(message, left, right, placeholder string, styles map[string]styleKind) (text string, spans []span) {
+	r := rewritten{
+		styles: styles,
+	}
+
+	offset := 0
+
+	for {
+		start := strings.Index(message[offset:], left)
+
+		if start < 0 {
+			r.unescape(message[offset:], offset, right)
+			break
+		}
+
+		r.unescape(message[offset:offset+start], offset, right)
+		offset += start + len(left)
+
+		if strings.HasPrefix(message[offset:], left) {
+			r.write(left + strconv.Quote(left) + right)
+			offset += len(left)
+
+			continue
+		}
+
+		r.write(left)
+
+		end := findActionEnd(message[offset:], right)
+
+		if end < 0 {
+			r.copy(message[offset:], offset)
+			break
+		}
+
+		r.action(message[offset:offset+end], offset, placeholder)
+		offset += end
+
+		r.copy(right, offset)
+		offset += len(right)
+	}
+
+	return r.builder.String(), r.spans
+}
+
+// write writes text that is not present in original message.
+func (r *rewritten) write(text string) {
+	r.builder.WriteString(text)
+}
+
+// copy writes text copied from original message at provided offset.
+func (r *rewritten) copy(text string, offset int) {
+	if text == "" {
+		return
+	}
+
+	r.spans = append(r.spans, span{
+		text:    r.builder.Len(),
+		message: offset,
+		length:  len(text),
+	})
+
+	r.builder.WriteString(text)
+}
+
+// unescape translates doubled right delimiters in text to literal delimiters.
+func (r *rewritten) unescape(text string, offset int, right string) {
+	for {
+		end := strings.Index(text, right+right)
+
+		if end < 0 {
+			r.copy(text, offset)
+			return
+		}
+
+		end += len(right)
+		r.copy(text[:end], offset)
+		text = text[end+len(right):]
+		offset += end + len(right)
+	}
+}
+
+// action rewrites single action with format specification.
+// Action without format specification is copied unchanged.
+func (r *rewritten) action(action string, offset int, placeholder string) {
+	body := strings.TrimLeft(action, "- \t\r\n")
+
+	if strings.HasPrefix(body, commentStart) {
+		r.copy(action, offset)
+		return
+	}
+
+	if r.block(action, body, offset) {
+		return
+	}
+
+	separator := findFormatSeparator(action)
+
+	if separator < 0 {
+		r.copy(action, offset)
+		return
+	}
+
+	expression, specification, trim := action[:separator], action[separator+1:], ""
+
+	if length := len(specification); (length >= 2) && hasRightTrimMarker(specification[length-2:]) {
+		specification, trim = specification[:length-2], specification[length-2:]
+	}
+
+	if trimmed := strings.TrimRight(specification, " \t\r\n"); trimmed != "" {
+		specification = trimmed
+	}
+
+	r.copy(expression, offset)
+
+	if body := strings.TrimSpace(expression); (body == "") || (body == string(trimMarker)) {
+		r.write(placeholder)
+	}
+
+	r.write(" | " + formatFunction + " " + strconv.Quote(specification))
+	r.copy(trim, offset+len(action)-len(trim))
+}
+
+// block tracks control blocks and style scopes closed by {end}. Style
+// scope is opened by color, text attribute or named style used without
+// arguments, or by parameterized style like {rgb 255 0 0}, only outside of
+// control blocks. Inside of control block {end} always closes the block,
+// {endStyle} must be used to close style scope. Actions like {reset} close
+// all style scopes opened in the current control block.
+// It returns true if action was {end} that closes style and it was rewritten.
+func (r *rewritten) block(action, body string, offset int) bool {
+	fields := strings.Fields(body)
+
+	if (len(fields) > 1) && (fields[len(fields)-1] == string(trimMarker)) {
+		fields = fields[:len(fields)-1]
+	}
+
+	switch {
+	case len(fields) == 0:
+		return false
+	case gBlockKeywords[fields[0]]:
+		r.blocks = append(r.blocks, false)
+	case (fields[0] == keywordEnd) && (len(fields) == 1):
+		return r.end(action, body, offset)
+	case r.opens(fields):
+		if !r.inBlock() {
+			r.blocks = append(r.blocks, true)
+		}
+	case r.closes(fields[0]):
+		if last := len(r.blocks) - 1; (last >= 0) && r.blocks[last] {
+			r.blocks = r.blocks[:last]
+		}
+	case r.resets(fields[0]):
+		for (len(r.blocks) > 0) && r.blocks[len(r.blocks)-1] {
+			r.blocks = r.blocks[:len(r.blocks)-1]
+		}
+	}
+
+	return false
+}
+
+// inBlock returns true if control block is waiting for its {end}.
+func (r *rewritten) inBlock() bool {
+	for _, style := range r.blocks {
+		if !style {
+			return true
+		}
+	}
+
+	return false
+}
+
+// closes returns true if function closes the last style scope.
+func (r *rewritten) closes(name string) bool {
+	kind, ok := r.styles[name]
+
+	return ok && (kind == styleCloser)
+}
+
+// opens returns true if action fields open style scope.
+func (r *rewritten) opens(fields []string) bool {
+	name := fields[0]
+
+	if index := strings.IndexByte(name, '|'); index >= 0 {
+		name, fields = name[:index], []string{name, "|"}
+	}
+
+	kind, ok := r.styles[name]
+
+	switch {
+	case !ok:
+		return false
+	case kind == styleParameterOpener:
+		return true
+	case kind == styleOpener:
+		return (len(fields) == 1) || strings.HasPrefix(fields[1], "|")
+	default:
+		return false
+	}
+}
+
+// resets returns true if function closes all style scopes.
+func (r *rewritten) resets(name string) bool {
+	kind, ok := r.styles[name]
+
+	return ok && (kind == styleReset)
+}
+
+// end closes control block or style scope. The {end} that closes style
+// scope is rewritten to {endStyle}. The {end} that closes nothing is kept
+// unchanged and it is reported as parse error.
+func (r *rewritten) end(action, body string, offset int) bool {
+	last := len(r.blocks) - 1
+
+	if last < 0 {
+		return false
+	}
+
+	closesStyle := r.blocks[last]
+	r.blocks = r.blocks[:last]
+
+	if !closesStyle {
+		return false
+	}
+
+	start := len(action) - len(body)
+
+	r.copy(action[:start], offset)
+	r.write(styleEnd)
+	r.copy(action[start+len(keywordEnd):], offset+start+len(keywordEnd))
+
+	return true
+}
+
+// position returns offset in original message for provided offset in
+// rewritten text. Offsets in text not present in original message are
+// mapped to the nearest preceding offset from original message.
+func position(spans []span, offset int) int {
+	result := 0
+
+	for _, s := range spans {
+		if s.text > offset {
+			break
+		}
+
+		result = s.message + s.length
+
+		if offset-s.text < s.length {
+			result = s.message + offset - s.text
+		}
+	}
+
+	return result
+}
+
+// findActionEnd returns position of right delimiter that closes action.
+// Delimiters inside quoted strings, raw strings and comments are skipped.
+func findActionEnd(action, right string) int {
+	position := 0
+
+	if hasLeftTrimMarker(action) {
+		position = 2
+	}
+
+	if strings.HasPrefix(action[position:], commentStart) {
+		end := strings.Index(action[position:], commentEnd)
+
+		if end < 0 {
+			return -1
+		}
+
+		position += end + len(commentEnd)
+	}
+
+	for position < len(action) {
+		if strings.HasPrefix(action[position:], right) {
+			return position
+		}
+
+		switch action[position] {
+		case '"', '\'', '`':
+			position = skipQuoted(action, position)
+		default:
+			position++
+		}
+	}
+
+	return -1
+}
+
+// skipQuoted returns position just after quoted string that starts at
+// provided position. It handles escaped characters in interpreted strings.
+func skipQuoted(action string, position int) int {
+	quote := action[position]
+	position++
+
+	for position < len(action) {
+		switch action[position] {
+		case '\\':
+			if quote != '`' {
+				position++
+			}
+		case quote:
+			return position + 1
+		}
+
+		position++
+	}
+
+	return position
+}
+
+// findFormatSeparator returns position of format specification separator.
+// It ignores separators used in quoted strings, parentheses and declarations.
+func findFormatSeparator(action string) int {
+	depth := 0
+	position := 0
+
+	for position < len(action) {
+		switch action[position] {
+		case '"', '\'', '`':
+			position = skipQuoted(action, position)
+			continue
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case formatSeparator:
+			if isDeclaration(action, position) {
+				position++
+			} else if depth == 0 {
+				return position
+			}
+		}
+
+		position++
+	}
+
+	return -1
+}
+
+// isDeclaration returns true if separator at provided position starts
+// variable declaration like {$x := p}. Otherwise, it is the format
+// specification with the '=' alignment like {p:=+6}.
+func isDeclaration(action string, position int) bool {
+	if (position+1 >= len(action)) || (action[position+1] != '=') {
+		return false
+	}
+
+	fields := strings.Fields(action[:position])
+
+	return (len(fields) > 0) && strings.HasPrefix(fields[len(fields)-1], "$")
+}
+
+func hasLeftTrimMarker(s string) bool {
+	return (len(s) >= 2) && (s[0] == trimMarker) && isSpace(s[1])
+}
+
+func hasRightTrimMarker(s string) bool {
+	return (len(s) >= 2) && isSpace(s[0]) && (s[1] == trimMarker)
+}
+
+func isSpace(c byte) bool {
+	return (c == ' ') || (c == '\t') || (c == '\r') || (c == '\n')
+}
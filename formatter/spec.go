@@ -0,0 +1,424 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultPrecision = 6
+	percent          = 100
+	groupSize        = 3
+	groupSizeBinary  = 4
+)
+
+// formatFunction is called by replacement fields with format specification
+// like {p:>10}. Unlike the format function it cannot be overridden.
+const formatFunction = "_format"
+
+const (
+	alignLeft   = '<'
+	alignRight  = '>'
+	alignCenter = '^'
+	alignSign   = '='
+)
+
+// formatSpec defines format specification mini-language known from Python:
+//
+//	[[fill]align][sign][#][0][width][grouping][.precision][type]
+type formatSpec struct {
+	fill      rune
+	align     rune
+	sign      rune
+	alternate bool
+	width     int
+	grouping  rune
+	precision int
+	verb      rune
+	budget    int
+}
+
+// setFormat formats value using format specification. Formatted value
+// cannot exceed remaining output bytes of execution bound to ctx.
+func setFormat(ctx context.Context, specification string, value interface{}) (string, error) {
+	spec, err := parseFormatSpec(specification, getRemainingOutput(ctx))
+
+	if err != nil {
+		return "", err
+	}
+
+	return spec.format(value)
+}
+
+// parseFormatSpec parses format specification. Negative budget means that
+// formatted value is not limited. Otherwise, width above budget returns
+// ErrOutputLimit error.
+func parseFormatSpec(specification string, budget int) (spec *formatSpec, err error) { // nolint: gocyclo
+	runes := []rune(specification)
+	position := 0
+
+	spec = &formatSpec{
+		fill:      ' ',
+		precision: -1,
+		budget:    budget,
+	}
+
+	switch {
+	case (len(runes) >= 2) && isAlign(runes[1]):
+		spec.fill, spec.align = runes[0], runes[1]
+		position = 2
+	case (len(runes) >= 1) && isAlign(runes[0]):
+		spec.align = runes[0]
+		position = 1
+	}
+
+	if (position < len(runes)) && strings.ContainsRune("+- ", runes[position]) {
+		spec.sign = runes[position]
+		position++
+	}
+
+	if (position < len(runes)) && (runes[position] == '#') {
+		spec.alternate = true
+		position++
+	}
+
+	if (position < len(runes)) && (runes[position] == '0') {
+		if spec.align == 0 {
+			spec.fill, spec.align = '0', alignSign
+		}
+
+		position++
+	}
+
+	if spec.width, position, err = parseFormatNumber(runes, position); err != nil {
+		return nil, err
+	}
+
+	if (budget >= 0) && (spec.width > budget) {
+		return nil, ErrOutputLimit
+	}
+
+	if (position < len(runes)) && ((runes[position] == ',') || (runes[position] == '_')) {
+		spec.grouping = runes[position]
+		position++
+	}
+
+	if (position < len(runes)) && (runes[position] == '.') {
+		start := position + 1
+
+		if spec.precision, position, err = parseFormatNumber(runes, start); err != nil {
+			return nil, err
+		}
+
+		if position == start {
+			return nil, fError("format specification is missing precision")
+		}
+	}
+
+	if (position < len(runes)) && strings.ContainsRune("bcdeEfFgGnosxX%", runes[position]) {
+		spec.verb = runes[position]
+		position++
+	}
+
+	if position != len(runes) {
+		return nil, fError(fmt.Sprintf("invalid format specification %q", specification))
+	}
+
+	return spec, nil
+}
+
+func parseFormatNumber(runes []rune, position int) (value, next int, err error) {
+	next = position
+
+	for (next < len(runes)) && (runes[next] >= '0') && (runes[next] <= '9') {
+		next++
+	}
+
+	if next == position {
+		return -1, next, nil
+	}
+
+	if value, err = strconv.Atoi(string(runes[position:next])); err != nil {
+		return 0, 0, err
+	}
+
+	return value, next, nil
+}
+
+func isAlign(r rune) bool {
+	return (r == alignLeft) || (r == alignRight) || (r == alignCenter) || (r == alignSign)
+}
+
+func (s *formatSpec) format(value interface{}) (string, error) {
+	if (s.verb == 0) || (s.verb == 's') {
+		switch value.(type) {
+		case fmt.Stringer, error:
+			return s.formatString(fmt.Sprint(value))
+		}
+	}
+
+	valueOf := reflect.ValueOf(value)
+
+	switch valueOf.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		integer := valueOf.Int()
+
+		if integer < 0 {
+			return s.formatInteger(true, uint64(-(integer+1))+1)
+		}
+
+		return s.formatInteger(false, uint64(integer))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return s.formatInteger(false, valueOf.Uint())
+	case reflect.Float32, reflect.Float64:
+		return s.formatFloat(valueOf.Float())
+	default:
+		return s.formatString(fmt.Sprint(value))
+	}
+}
+
+func (s *formatSpec) formatInteger(negative bool, magnitude uint64) (string, error) {
+	var prefix, digits string
+
+	if (s.precision >= 0) && !strings.ContainsRune("eEfFgG%", s.verb) {
+		return "", fError("precision is not allowed in integer format specification")
+	}
+
+	size := groupSizeBinary
+
+	switch s.verb {
+	case 0, 'd', 'n':
+		digits, size = strconv.FormatUint(magnitude, 10), groupSize
+	case 'b':
+		prefix, digits = "0b", strconv.FormatUint(magnitude, 2)
+	case 'o':
+		prefix, digits = "0o", strconv.FormatUint(magnitude, 8)
+	case 'x':
+		prefix, digits = "0x", strconv.FormatUint(magnitude, 16)
+	case 'X':
+		prefix, digits = "0X", strings.ToUpper(strconv.FormatUint(magnitude, 16))
+	case 'c':
+		if negative || (magnitude > utf8.MaxRune) {
+			return "", fError("character code is out of range")
+		}
+
+		return s.pad("", string(rune(magnitude)), alignRight)
+	case 'e', 'E', 'f', 'F', 'g', 'G', '%':
+		if negative {
+			return s.formatFloat(-float64(magnitude))
+		}
+
+		return s.formatFloat(float64(magnitude))
+	default:
+		return "", fError(fmt.Sprintf("unknown format code %q for integer", s.verb))
+	}
+
+	if !s.alternate {
+		prefix = ""
+	}
+
+	prefix = s.signOf(negative) + prefix
+
+	return s.pad(prefix, s.fillGroup(prefix, digits, "", size), alignRight)
+}
+
+func (s *formatSpec) formatFloat(value float64) (string, error) {
+	var digits string
+
+	negative := math.Signbit(value)
+	value = math.Abs(value)
+	precision := s.precision
+
+	if (precision < 0) && (s.verb != 0) && (s.verb != 'n') {
+		precision = defaultPrecision
+	}
+
+	if (s.budget >= 0) && (precision > s.budget) && strings.ContainsRune("eEfF%", s.verb) {
+		return "", ErrOutputLimit
+	}
+
+	switch s.verb {
+	case 0, 'n':
+		digits = formatShortestFloat(value, precision)
+	case 'g', 'G':
+		digits = strconv.FormatFloat(value, 'g', precision, 64)
+	case 'e', 'E':
+		digits = strconv.FormatFloat(value, 'e', precision, 64)
+	case 'f', 'F':
+		digits = strconv.FormatFloat(value, 'f', precision, 64)
+	case '%':
+		digits = strconv.FormatFloat(value*percent, 'f', precision, 64) + "%"
+	default:
+		return "", fError(fmt.Sprintf("unknown format code %q for float", s.verb))
+	}
+
+	switch {
+	case math.IsInf(value, 0):
+		digits = "inf"
+	case math.IsNaN(value):
+		digits = "nan"
+	default:
+		end := strings.IndexAny(digits, ".e%")
+
+		if end < 0 {
+			end = len(digits)
+		}
+
+		digits = s.fillGroup(s.signOf(negative), digits[:end], digits[end:], groupSize)
+	}
+
+	if (s.verb == 'E') || (s.verb == 'F') || (s.verb == 'G') {
+		digits = strings.ToUpper(digits)
+	}
+
+	return s.pad(s.signOf(negative), digits, alignRight)
+}
+
+func (s *formatSpec) formatString(value string) (string, error) {
+	switch {
+	case (s.verb != 0) && (s.verb != 's'):
+		return "", fError(fmt.Sprintf("unknown format code %q for string", s.verb))
+	case s.sign != 0:
+		return "", fError("sign is not allowed in string format specification")
+	case s.grouping != 0:
+		return "", fError("grouping is not allowed in string format specification")
+	case s.align == alignSign:
+		return "", fError("'=' alignment is not allowed in string format specification")
+	}
+
+	if (s.precision >= 0) && (utf8.RuneCountInString(value) > s.precision) {
+		value = string([]rune(value)[:s.precision])
+	}
+
+	return s.pad("", value, alignLeft)
+}
+
+func (s *formatSpec) signOf(negative bool) string {
+	switch {
+	case negative:
+		return "-"
+	case s.sign == '+':
+		return "+"
+	case s.sign == ' ':
+		return " "
+	default:
+		return ""
+	}
+}
+
+func (s *formatSpec) group(digits string, size int) string {
+	if (s.grouping == 0) || (len(digits) <= size) {
+		return digits
+	}
+
+	if (s.grouping == ',') && (size != groupSize) {
+		return digits
+	}
+
+	var builder strings.Builder
+
+	for position, digit := range digits {
+		if (position > 0) && ((len(digits)-position)%size == 0) {
+			builder.WriteRune(s.grouping)
+		}
+
+		builder.WriteRune(digit)
+	}
+
+	return builder.String()
+}
+
+// fillGroup returns grouped digits followed by rest. With zero padding
+// and grouping like {p:08,} digits are zero-filled before grouping, so
+// padding zeros are grouped as well.
+func (s *formatSpec) fillGroup(prefix, digits, rest string, size int) string {
+	if (s.grouping == 0) || (s.fill != '0') || (s.align != alignSign) {
+		return s.group(digits, size) + rest
+	}
+
+	width := s.width - utf8.RuneCountInString(prefix) - utf8.RuneCountInString(rest)
+	length := len(digits)
+
+	for s.groupedLength(length, size) < width {
+		length++
+	}
+
+	return s.group(strings.Repeat("0", length-len(digits))+digits, size) + rest
+}
+
+// groupedLength returns length of grouped digits for provided number of digits.
+func (s *formatSpec) groupedLength(length, size int) int {
+	if (s.grouping == 0) || (length == 0) || ((s.grouping == ',') && (size != groupSize)) {
+		return length
+	}
+
+	return length + (length-1)/size
+}
+
+// pad returns prefix and value padded to width. It returns ErrOutputLimit
+// error before padding is built when padded value exceeds budget.
+func (s *formatSpec) pad(prefix, value string, align rune) (string, error) {
+	length := utf8.RuneCountInString(prefix) + utf8.RuneCountInString(value)
+
+	if s.width <= length {
+		return prefix + value, nil
+	}
+
+	if s.align != 0 {
+		align = s.align
+	}
+
+	fill := s.width - length
+
+	if (s.budget >= 0) && (len(prefix)+len(value)+fill*utf8.RuneLen(s.fill) > s.budget) {
+		return "", ErrOutputLimit
+	}
+
+	switch align {
+	case alignLeft:
+		return prefix + value + strings.Repeat(string(s.fill), fill), nil
+	case alignCenter:
+		return strings.Repeat(string(s.fill), fill/2) + prefix + value + strings.Repeat(string(s.fill), fill-fill/2), nil
+	case alignSign:
+		return prefix + strings.Repeat(string(s.fill), fill) + value, nil
+	default:
+		return strings.Repeat(string(s.fill), fill) + prefix + value, nil
+	}
+}
+
+// formatShortestFloat formats float like Python repr. It uses the shortest
+// fixed-point notation unless exponent is less than -4 or at least 16.
+// With precision it formats float like the 'g' type.
+func formatShortestFloat(value float64, precision int) string {
+	if precision >= 0 {
+		return strconv.FormatFloat(value, 'g', precision, 64)
+	}
+
+	exponential := strconv.FormatFloat(value, 'e', -1, 64)
+	exponent, err := strconv.Atoi(exponential[strings.IndexByte(exponential, 'e')+1:])
+
+	if (err == nil) && (value != 0) && ((exponent < -4) || (exponent >= 16)) {
+		return exponential
+	}
+
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,429 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// These constants define how style function changes style scopes.
+const (
+	// styleOpener opens style scope when used without arguments. Used with
+	// arguments it styles only provided text.
+	styleOpener styleKind = iota
+
+	// styleParameterOpener opens style scope like {rgb 255 0 0}.
+	styleParameterOpener
+
+	// styleTransform transforms style of the current scope like {red | bright}.
+	styleTransform
+
+	// styleReset closes all style scopes.
+	styleReset
+
+	// styleCloser closes the last style scope.
+	styleCloser
+)
+
+const (
+	styleFunction    = "style"
+	styleEnd         = "endStyle"
+	styleBackground  = "on"
+	styleBright      = "bright"
+	themeComment     = '#'
+	themeSectionLeft = '['
+)
+
+// gStyleKinds defines how functions open, transform or close style scopes.
+var gStyleKinds = map[string]styleKind{ // nolint: gochecknoglobals
+	"bold":        styleOpener,
+	"faint":       styleOpener,
+	"italic":      styleOpener,
+	"underline":   styleOpener,
+	"overline":    styleOpener,
+	"blink":       styleOpener,
+	"invert":      styleOpener,
+	"hide":        styleOpener,
+	"strike":      styleOpener,
+	"black":       styleOpener,
+	"red":         styleOpener,
+	"green":       styleOpener,
+	"yellow":      styleOpener,
+	"blue":        styleOpener,
+	"magenta":     styleOpener,
+	"cyan":        styleOpener,
+	"white":       styleOpener,
+	"gray":        styleOpener,
+	"rgb":         styleParameterOpener,
+	"ansi256":     styleParameterOpener,
+	"color":       styleParameterOpener,
+	styleFunction: styleParameterOpener,
+	"bright":      styleTransform,
+	"background":  styleTransform,
+	"foreground":  styleTransform,
+	"reset":       styleReset,
+	"normal":      styleReset,
+	"default":     styleReset,
+	styleEnd:      styleCloser,
+}
+
+// Styles defines named styles. Style is a space separated list of text
+// attributes like bold or underline and colors accepted by color function
+// like red, tomato or #FF6347. Color preceded by "on" is a background color.
+// The "bright" makes preceding color bright. Example: "bold white on red".
+type Styles map[string]string
+
+// Theme defines named styles with variants like dark or light. Styles from
+// selected variant override base styles.
+type Theme struct {
+	Styles   Styles
+	Variants map[string]Styles
+}
+
+// styleKind defines how style function changes style scopes.
+type styleKind int
+
+// styleStack tracks styles opened during single execution of message.
+type styleStack struct {
+	renderer StyleRenderer
+	codes    []string
+}
+
+type styleCode struct {
+	code string
+	err  error
+}
+
+// ParseTheme parses theme from reader. Each line defines a single style in
+// the name = style format. Lines starting with # are comments. Section like
+// [dark] starts variant of styles:
+//
+//	error = bold red
+//	path  = underline cyan
+//
+//	[light]
+//	error = bold #B00000
+func ParseTheme(reader io.Reader) (*Theme, error) {
+	theme := &Theme{
+		Styles:   Styles{},
+		Variants: map[string]Styles{},
+	}
+
+	styles := theme.Styles
+	scanner := bufio.NewScanner(reader)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case (text == "") || (text[0] == themeComment):
+			continue
+		case (text[0] == themeSectionLeft) && strings.HasSuffix(text, "]"):
+			variant := strings.TrimSpace(text[1 : len(text)-1])
+
+			if theme.Variants[variant] == nil {
+				theme.Variants[variant] = Styles{}
+			}
+
+			styles = theme.Variants[variant]
+
+			continue
+		}
+
+		separator := strings.IndexByte(text, '=')
+
+		if separator < 0 {
+			return nil, fError("theme line " + strconv.Itoa(line) + ": expected name = style")
+		}
+
+		name, style := strings.TrimSpace(text[:separator]), strings.TrimSpace(text[separator+1:])
+
+		if _, err := compileStyle(style, NoopStyleRenderer{}); err != nil {
+			return nil, fError("theme line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+
+		styles[name] = style
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return theme, nil
+}
+
+// clone returns a deep copy of theme. Nil theme gives an empty theme.
+func (t *Theme) clone() *Theme {
+	cloned := &Theme{
+		Styles:   Styles{},
+		Variants: map[string]Styles{},
+	}
+
+	if t == nil {
+		return cloned
+	}
+
+	for name, style := range t.Styles {
+		cloned.Styles[name] = style
+	}
+
+	for variant, styles := range t.Variants {
+		cloned.Variants[variant] = Styles{}
+
+		for name, style := range styles {
+			cloned.Variants[variant][name] = style
+		}
+	}
+
+	return cloned
+}
+
+// resolve returns base styles overridden by styles from variant.
+func (t *Theme) resolve(variant string) Styles {
+	styles := Styles{}
+
+	if t == nil {
+		return styles
+	}
+
+	for name, style := range t.Styles {
+		styles[name] = style
+	}
+
+	for name, style := range t.Variants[variant] {
+		styles[name] = style
+	}
+
+	return styles
+}
+
+// getStyleFunctions returns style function, function for each named style
+// and function that ends style. Named styles that are not identifiers like
+// log-error are available only as {style "log-error"}.
+func getStyleFunctions(styles Styles, renderer StyleRenderer) template.FuncMap {
+	codes := make(map[string]styleCode, len(styles))
+	functions := make(template.FuncMap, len(styles)+2)
+
+	for name, style := range styles {
+		code, err := compileStyle(style, renderer)
+		codes[name] = styleCode{code: code, err: err}
+	}
+
+	for name := range codes {
+		if !isIdentifier(name) {
+			continue
+		}
+
+		c := codes[name]
+
+		functions[name] = func() (string, error) {
+			return c.code, c.err
+		}
+	}
+
+	functions[styleFunction] = func(name string) (string, error) {
+		c, ok := codes[name]
+
+		if !ok {
+			return "", fError("style " + strconv.Quote(name) + " is not defined")
+		}
+
+		return c.code, c.err
+	}
+
+	functions[styleEnd] = renderer.Reset
+
+	return functions
+}
+
+// compileStyle returns style rendered by renderer.
+func compileStyle(style string, renderer StyleRenderer) (string, error) {
+	var values []styleValue
+
+	last := -1
+	background := false
+
+	for _, token := range strings.Fields(strings.ToLower(style)) {
+		if attribute, ok := gAttributes[token]; ok {
+			values = append(values, styleValue{renderer: renderer, kind: valueAttribute, attribute: attribute})
+			continue
+		}
+
+		switch token {
+		case styleBackground:
+			background = true
+			continue
+		case styleBright:
+			if last < 0 {
+				return "", fError("bright must follow color in style " + strconv.Quote(style))
+			}
+
+			value, err := setBright(values[last])
+
+			if err != nil {
+				return "", err
+			}
+
+			values[last] = value
+
+			continue
+		}
+
+		value, err := parseColor(renderer, token)
+
+		if (err == nil) && background {
+			value, err = setBackground(value)
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		background = false
+		last = len(values)
+		values = append(values, value)
+	}
+
+	if background {
+		return "", fError("on must precede color in style " + strconv.Quote(style))
+	}
+
+	var builder strings.Builder
+
+	for _, value := range values {
+		builder.WriteString(value.String())
+	}
+
+	return builder.String(), nil
+}
+
+// getStyleKinds returns kinds of style functions. Named styles are style
+// openers. Functions overridden by user functions are not style functions.
+func getStyleKinds(functions template.FuncMap, styles Styles, user Functions) map[string]styleKind {
+	kinds := make(map[string]styleKind)
+
+	for name := range functions {
+		if kind, ok := gStyleKinds[name]; ok {
+			kinds[name] = kind
+		}
+	}
+
+	for name := range styles {
+		if isIdentifier(name) {
+			kinds[name] = styleOpener
+		}
+	}
+
+	for name := range user {
+		delete(kinds, name)
+	}
+
+	return kinds
+}
+
+// wrap returns function that calls provided style function and tracks
+// returned style on stack.
+func (s *styleStack) wrap(kind styleKind, function interface{}) interface{} {
+	value := reflect.ValueOf(function)
+
+	switch kind {
+	case styleCloser:
+		return s.end
+	case styleReset:
+		return func() interface{} {
+			s.codes = nil
+			return value.Call(nil)[0].Interface()
+		}
+	case styleTransform:
+		return func(in interface{}) (interface{}, error) {
+			argument := reflect.ValueOf(in)
+
+			if !argument.IsValid() || !argument.Type().AssignableTo(value.Type().In(0)) {
+				return nil, fError("function can be used only with colors and text attributes")
+			}
+
+			results := value.Call([]reflect.Value{argument})
+
+			if !results[1].IsNil() {
+				return nil, results[1].Interface().(error)
+			}
+
+			out := results[0].Interface()
+
+			if last := len(s.codes) - 1; (last >= 0) && (s.codes[last] == fmt.Sprint(in)) {
+				s.codes[last] = fmt.Sprint(out)
+			}
+
+			return out, nil
+		}
+	case styleParameterOpener:
+		return reflect.MakeFunc(value.Type(), func(arguments []reflect.Value) []reflect.Value {
+			results := value.Call(arguments)
+
+			if (len(results) == 1) || results[1].IsNil() {
+				s.codes = append(s.codes, fmt.Sprint(results[0].Interface()))
+			}
+
+			return results
+		}).Interface()
+	default:
+		return func(texts ...interface{}) (interface{}, error) {
+			results := value.Call(nil)
+
+			if (len(results) > 1) && !results[1].IsNil() {
+				return nil, results[1].Interface().(error)
+			}
+
+			code := fmt.Sprint(results[0].Interface())
+
+			if len(texts) == 0 {
+				s.codes = append(s.codes, code)
+				return results[0].Interface(), nil
+			}
+
+			return s.inline(code, fmt.Sprint(texts...)), nil
+		}
+	}
+}
+
+// end closes the last opened style and restores enclosing styles.
+func (s *styleStack) end() string {
+	if len(s.codes) > 0 {
+		s.codes = s.codes[:len(s.codes)-1]
+	}
+
+	return s.restore()
+}
+
+// inline returns styled text followed by enclosing styles. Enclosing and
+// provided styles are applied again after every reset in text.
+func (s *styleStack) inline(code, text string) string {
+	if reset := s.renderer.Reset(); reset != "" {
+		text = strings.ReplaceAll(text, reset, reset+strings.Join(s.codes, "")+code)
+	}
+
+	return code + text + s.restore()
+}
+
+// restore returns reset followed by all styles from stack.
+func (s *styleStack) restore() string {
+	return s.renderer.Reset() + strings.Join(s.codes, "")
+}
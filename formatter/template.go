@@ -0,0 +1,219 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"context"
+	"text/template"
+	"text/template/parse"
+)
+
+// gReserved defines functions bound by bind after placeholders and custom
+// functions. Placeholders and custom functions cannot override them.
+var gReserved = map[string]bool{ // nolint: gochecknoglobals
+	formatFunction:    true,
+	iterationFunction: true,
+}
+
+var gBuiltins = map[string]bool{ // nolint: gochecknoglobals
+	"and":      true,
+	"call":     true,
+	"html":     true,
+	"index":    true,
+	"slice":    true,
+	"js":       true,
+	"len":      true,
+	"not":      true,
+	"or":       true,
+	"print":    true,
+	"printf":   true,
+	"println":  true,
+	"urlquery": true,
+	"eq":       true,
+	"ge":       true,
+	"gt":       true,
+	"le":       true,
+	"lt":       true,
+	"ne":       true,
+}
+
+// renderTarget defines destination of formatted message.
+type renderTarget int
+
+// These constants define destinations of formatted message. Writer gets
+// message rendered by style renderer, backend gets message rendered by
+// backendRenderer and FormatDual gets message rendered by dualRenderer.
+const (
+	renderWriter renderTarget = iota
+	renderBackend
+	renderDual
+)
+
+// compiled holds parsed template with identifiers that cannot be resolved
+// at parse time. These are placeholders, provided later during execution.
+type compiled struct {
+	message         string
+	text            string
+	spans           []span
+	leftDelimiter   string
+	rightDelimiter  string
+	template        *template.Template
+	identifiers     []*parse.IdentifierNode
+	functions       map[string]bool
+	styles          template.FuncMap
+	contexts        template.FuncMap
+	kinds           map[string]styleKind
+	escapeSequences bool
+	target          renderTarget
+	renderer        StyleRenderer
+	capabilities    Capability
+}
+
+func compile(message, left, right, placeholder string, functions template.FuncMap, styles map[string]styleKind) (*compiled, error) {
+	t := template.New("").Delims(left, right).Funcs(functions)
+	text, spans := rewrite(message, left, right, placeholder, styles)
+
+	c := &compiled{
+		message:        message,
+		text:           text,
+		spans:          spans,
+		leftDelimiter:  left,
+		rightDelimiter: right,
+		template:       t,
+		functions:      make(map[string]bool),
+		styles:         make(template.FuncMap),
+		contexts:       make(template.FuncMap),
+		kinds:          styles,
+	}
+
+	tree := parse.New("")
+	tree.Mode = parse.SkipFuncCheck
+	trees := make(map[string]*parse.Tree)
+
+	if _, err := tree.Parse(text, left, right, trees); err != nil {
+		return nil, newParseError(c, err)
+	}
+
+	for name, tree := range trees {
+		if _, err := t.AddParseTree(name, tree); err != nil {
+			return nil, newParseError(c, err)
+		}
+
+		c.collect(tree.Root, functions, styles)
+	}
+
+	return c, nil
+}
+
+// bind returns a copy of compiled template with provided placeholders.
+// Template can be executed concurrently with other copies. Used style
+// functions are bound to a new style stack that restores enclosing styles.
+// Used functions that take context as the first parameter are bound to ctx.
+// Placeholders override built-in functions with the same name. Reserved
+// functions override both placeholders and built-in functions.
+func (c *compiled) bind(ctx context.Context, placeholders, reserved template.FuncMap) (*template.Template, error) {
+	for name := range c.functions {
+		delete(placeholders, name)
+	}
+
+	for _, identifier := range c.identifiers {
+		if _, ok := placeholders[identifier.Ident]; !ok {
+			if !isAllowed(identifier.Ident, c.capabilities) {
+				return nil, newNotAllowedError(c, identifier.Ident, int(identifier.Pos))
+			}
+
+			return nil, newUndefinedError(c, identifier.Ident, int(identifier.Pos))
+		}
+	}
+
+	t, err := c.template.Clone()
+
+	if err != nil {
+		return nil, newExecuteError(c, err)
+	}
+
+	if len(c.styles) > 0 {
+		stack := &styleStack{
+			renderer: c.renderer,
+		}
+
+		for name, function := range c.styles {
+			if _, ok := placeholders[name]; !ok {
+				placeholders[name] = stack.wrap(c.kinds[name], function)
+			}
+		}
+	}
+
+	for name, function := range c.contexts {
+		if _, ok := placeholders[name]; !ok {
+			placeholders[name] = bindContext(ctx, function)
+		}
+	}
+
+	for name, function := range reserved {
+		placeholders[name] = function
+	}
+
+	return t.Funcs(placeholders), nil
+}
+
+func (c *compiled) collect(node parse.Node, functions template.FuncMap, styles map[string]styleKind) { // nolint: gocyclo
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			for _, item := range n.Nodes {
+				c.collect(item, functions, styles)
+			}
+		}
+	case *parse.ActionNode:
+		c.collect(n.Pipe, functions, styles)
+	case *parse.PipeNode:
+		if n != nil {
+			for _, command := range n.Cmds {
+				c.collect(command, functions, styles)
+			}
+		}
+	case *parse.CommandNode:
+		for _, argument := range n.Args {
+			c.collect(argument, functions, styles)
+		}
+	case *parse.ChainNode:
+		c.collect(n.Node, functions, styles)
+	case *parse.IfNode:
+		c.collect(&n.BranchNode, functions, styles)
+	case *parse.RangeNode:
+		c.collect(&n.BranchNode, functions, styles)
+	case *parse.WithNode:
+		c.collect(&n.BranchNode, functions, styles)
+	case *parse.BranchNode:
+		c.collect(n.Pipe, functions, styles)
+		c.collect(n.List, functions, styles)
+		c.collect(n.ElseList, functions, styles)
+	case *parse.TemplateNode:
+		c.collect(n.Pipe, functions, styles)
+	case *parse.IdentifierNode:
+		function, ok := functions[n.Ident]
+		_, styled := styles[n.Ident]
+
+		switch {
+		case ok && styled:
+			c.styles[n.Ident] = function
+		case ok && takesContext(function):
+			c.contexts[n.Ident] = function
+		case !ok && !gBuiltins[n.Ident] && !gReserved[n.Ident]:
+			c.identifiers = append(c.identifiers, n)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-isatty"
+)
+
+// These constants define environment variables used to detect support of
+// ANSI escape sequences. See AreEscapeSequencesSupported for precedence.
+const (
+	NoColorEnv       = "NO_COLOR"
+	CliColorEnv      = "CLICOLOR"
+	CliColorForceEnv = "CLICOLOR_FORCE"
+	ColorTermEnv     = "COLORTERM"
+	TermEnv          = "TERM"
+)
+
+// These constants define modes of ANSI escape sequences in formatted messages.
+const (
+	// EscapeSequencesAuto detects support of ANSI escape sequences for
+	// destination writer that provides Fd() method like *os.File. Other
+	// writers use result of AreEscapeSequencesSupported.
+	EscapeSequencesAuto EscapeSequencesMode = iota
+
+	// EscapeSequencesAlways always allows ANSI escape sequences.
+	EscapeSequencesAlways
+
+	// EscapeSequencesNever always removes ANSI escape sequences.
+	EscapeSequencesNever
+)
+
+var gTerminals sync.Map // nolint: gochecknoglobals
+
+// EscapeSequencesMode defines how formatter decides about ANSI escape
+// sequences in formatted messages.
+type EscapeSequencesMode int
+
+// EscapeSequencesDecision defines resolved decision about ANSI escape
+// sequences with a human readable reason useful for debugging.
+type EscapeSequencesDecision struct {
+	Enabled bool
+	Reason  string
+}
+
+type fileDescriptor interface {
+	Fd() uintptr
+}
+
+// String returns name of escape sequences mode.
+func (m EscapeSequencesMode) String() string {
+	switch m {
+	case EscapeSequencesAuto:
+		return "auto"
+	case EscapeSequencesAlways:
+		return "always"
+	case EscapeSequencesNever:
+		return "never"
+	default:
+		return "unknown"
+	}
+}
+
+// String returns decision with reason.
+func (d EscapeSequencesDecision) String() string {
+	if d.Enabled {
+		return "enabled: " + d.Reason
+	}
+
+	return "disabled: " + d.Reason
+}
+
+// AreEscapeSequencesSupported returns true if environment supports ANSI escape sequences.
+// Otherwise, it returns false. Environment variables are checked in order:
+//
+//	FORCE_ESCAPE_SEQUENCES  enables or disables escape sequences when set to known value
+//	NO_COLOR                disables escape sequences when set to non-empty value
+//	CLICOLOR_FORCE          enables escape sequences when set to value other than 0
+//	CLICOLOR                disables escape sequences when set to 0
+//	TERM                    disables escape sequences when set to dumb, unless COLORTERM is set
+//
+// Otherwise, escape sequences are enabled only for terminal.
+func AreEscapeSequencesSupported() bool {
+	return DetectEscapeSequences().Enabled
+}
+
+// AreEscapeSequencesSupportedBy returns true if writer supports ANSI escape
+// sequences. Writer must provide Fd() method like *os.File. Otherwise, it
+// returns false. Result of terminal detection is cached per file descriptor
+// for the life of the process. See ClearTerminalCache.
+func AreEscapeSequencesSupportedBy(writer io.Writer) bool {
+	return DetectEscapeSequencesBy(writer).Enabled
+}
+
+// ClearTerminalCache clears results of terminal detection cached per file
+// descriptor. Cached result is stale when file descriptor is closed and its
+// number is reused, for example when descriptor of terminal is later reused
+// for a regular file. Call it after reopening files passed as writers.
+func ClearTerminalCache() {
+	gTerminals.Range(func(fd, _ interface{}) bool {
+		gTerminals.Delete(fd)
+		return true
+	})
+}
+
+// DetectEscapeSequences returns decision about ANSI escape sequences for
+// standard output with a reason. See AreEscapeSequencesSupported for details.
+func DetectEscapeSequences() EscapeSequencesDecision {
+	return detectEscapeSequences(os.Stdout.Fd())
+}
+
+// DetectEscapeSequencesBy returns decision about ANSI escape sequences for
+// writer with a reason. See AreEscapeSequencesSupportedBy for details.
+func DetectEscapeSequencesBy(writer io.Writer) EscapeSequencesDecision {
+	file, ok := writer.(fileDescriptor)
+
+	if !ok {
+		return EscapeSequencesDecision{
+			Reason: "writer does not provide file descriptor",
+		}
+	}
+
+	return detectEscapeSequences(file.Fd())
+}
+
+func detectEscapeSequences(fd uintptr) EscapeSequencesDecision {
+	if decision, ok := detectEscapeSequencesEnv(); ok {
+		return decision
+	}
+
+	if !isTerminal(fd) {
+		return EscapeSequencesDecision{Reason: "not a terminal"}
+	}
+
+	return EscapeSequencesDecision{Enabled: true, Reason: "terminal"}
+}
+
+// detectEscapeSequencesEnv returns decision about ANSI escape sequences
+// made by environment variables and true. Otherwise, it returns false.
+func detectEscapeSequencesEnv() (EscapeSequencesDecision, bool) {
+	force := os.Getenv(ForceEscapeSequencesEnv)
+
+	switch strings.TrimSpace(strings.ToLower(force)) {
+	case "1", "true", "on", "yes", "enable", "y":
+		return EscapeSequencesDecision{Enabled: true, Reason: ForceEscapeSequencesEnv + "=" + force}, true
+	case "0", "false", "off", "no", "disable", "n":
+		return EscapeSequencesDecision{Reason: ForceEscapeSequencesEnv + "=" + force}, true
+	}
+
+	if os.Getenv(NoColorEnv) != "" {
+		return EscapeSequencesDecision{Reason: NoColorEnv + " is set"}, true
+	}
+
+	if value := os.Getenv(CliColorForceEnv); (value != "") && (value != "0") {
+		return EscapeSequencesDecision{Enabled: true, Reason: CliColorForceEnv + "=" + value}, true
+	}
+
+	if os.Getenv(CliColorEnv) == "0" {
+		return EscapeSequencesDecision{Reason: CliColorEnv + "=0"}, true
+	}
+
+	if (os.Getenv(TermEnv) == "dumb") && (os.Getenv(ColorTermEnv) == "") {
+		return EscapeSequencesDecision{Reason: TermEnv + "=dumb"}, true
+	}
+
+	return EscapeSequencesDecision{}, false
+}
+
+func isTerminal(fd uintptr) bool {
+	if terminal, ok := gTerminals.Load(fd); ok {
+		return terminal.(bool)
+	}
+
+	terminal := isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+
+	gTerminals.Store(fd, terminal)
+
+	return terminal
+}
+
+// escapeSequencesFor returns decision about ANSI escape sequences in messages
+// formatted to writer. Writer can be nil.
+func (cfg *config) escapeSequencesFor(writer io.Writer) EscapeSequencesDecision {
+	switch cfg.escapeSequences {
+	case EscapeSequencesAlways:
+		return EscapeSequencesDecision{Enabled: true, Reason: "mode is always"}
+	case EscapeSequencesNever:
+		return EscapeSequencesDecision{Reason: "mode is never"}
+	}
+
+	if _, ok := writer.(fileDescriptor); ok {
+		return DetectEscapeSequencesBy(writer)
+	}
+
+	return gEscapeSequences
+}
+
+func getEscapeSequencesMode(escapeSequences bool) EscapeSequencesMode {
+	if escapeSequences {
+		return EscapeSequencesAlways
+	}
+
+	return EscapeSequencesNever
+}
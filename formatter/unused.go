@@ -0,0 +1,118 @@
+// Copyright 2020 Tymoteusz Blazejczyk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package formatter
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Unused defines argument not used by formatted message.
+type Unused struct {
+	Name     string
+	Position int
+	Argument interface{}
+}
+
+// UnusedHandler defines handler called with arguments not used by formatted
+// message. Formatted message was already written to writer. Provided
+// message is the original message with placeholders.
+type UnusedHandler func(writer io.Writer, message string, unused []Unused) error
+
+// AppendUnused appends unused arguments to formatted message separated by space.
+// It is the default handler.
+func AppendUnused(writer io.Writer, message string, unused []Unused) error {
+	var builder strings.Builder
+
+	separator := getSeparator(message)
+
+	for _, u := range unused {
+		builder.WriteString(separator + fmt.Sprint(u.Argument))
+		separator = " "
+	}
+
+	if err := write(writer, builder.String()); err != nil {
+		return newWriterError(message, err)
+	}
+
+	return nil
+}
+
+// DropUnused silently drops unused arguments.
+func DropUnused(io.Writer, string, []Unused) error {
+	return nil
+}
+
+// ErrorUnused returns ErrUnused error for the first unused argument.
+func ErrorUnused(_ io.Writer, message string, unused []Unused) error {
+	return newUnusedError(message, unused[0].Name)
+}
+
+// KeyValueUnused appends unused arguments to formatted message as key=value
+// pairs separated by space. Maps with string keys are expanded to pairs
+// sorted by keys. Other arguments use placeholder name as a key.
+// Values with spaces, quotes or equal signs are quoted.
+func KeyValueUnused(writer io.Writer, message string, unused []Unused) error {
+	var builder strings.Builder
+
+	separator := getSeparator(message)
+
+	for _, u := range unused {
+		for _, pair := range getKeyValuePairs(u) {
+			builder.WriteString(separator + pair)
+			separator = " "
+		}
+	}
+
+	if err := write(writer, builder.String()); err != nil {
+		return newWriterError(message, err)
+	}
+
+	return nil
+}
+
+func getKeyValuePairs(u Unused) (pairs []string) {
+	valueOf := reflect.ValueOf(u.Argument)
+
+	if (valueOf.Kind() != reflect.Map) || (valueOf.Type().Key().Kind() != reflect.String) {
+		return []string{u.Name + "=" + quoteValue(u.Argument)}
+	}
+
+	keys := valueOf.MapKeys()
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	for _, key := range keys {
+		pairs = append(pairs, key.String()+"="+quoteValue(valueOf.MapIndex(key).Interface()))
+	}
+
+	return pairs
+}
+
+func quoteValue(value interface{}) string {
+	text := fmt.Sprint(value)
+
+	if (text == "") || strings.ContainsAny(text, " \t\r\n\"=") {
+		return strconv.Quote(text)
+	}
+
+	return text
+}
@@ -17,7 +17,6 @@ module gitlab.com/tymonx/go-formatter
 go 1.14
 
 require (
-	github.com/golang/mock v1.4.4
 	github.com/mattn/go-isatty v0.0.12
 	github.com/stretchr/testify v1.6.1
 )